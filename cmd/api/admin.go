@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/embracexyz/greenlight/internal/data"
+	"github.com/embracexyz/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	input.Email = app.readString(qs, "email", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if data.ValidateFilters(v, &input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	users, metadata, err := app.models.UserModel.GetAll(r.Context(), input.Email, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 用户详情：角色、直接授予的权限以及合并后的有效权限
+func (app *application) showUserAccessHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.UserModel.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeUserAccess(w, r, http.StatusOK, user)
+}
+
+func (app *application) writeUserAccess(w http.ResponseWriter, r *http.Request, status int, user *data.User) {
+	roles, err := app.models.RoleModel.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	direct, err := app.models.PermisionModel.GetDirectForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.PermisionModel.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if direct == nil {
+		direct = data.Permisions{}
+	}
+	if permissions == nil {
+		permissions = data.Permisions{}
+	}
+
+	message := envelope{
+		"user":               user,
+		"roles":              roles,
+		"direct_permissions": direct,
+		"permissions":        permissions,
+	}
+	err = app.writeJson(w, status, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 读取路径中的用户id并确认用户存在
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.UserModel.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+func (app *application) addUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Role string `json:"role"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Role != "", "role", "must be provided")
+	v.Check(!validator.In(input.Role, data.MembershipRoles...), "role", "must be granted through an organization membership")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.RoleModel.AddForUser(r.Context(), user.ID, input.Role)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "user.role_add", "user", user.ID, nil, envelope{"role": input.Role}))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddFieldError("role", "role does not exist")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeUserAccess(w, r, http.StatusOK, user)
+}
+
+func (app *application) removeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	role := httprouter.ParamsFromContext(r.Context()).ByName("role")
+	err := app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.RoleModel.RemoveForUser(r.Context(), user.ID, role)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "user.role_remove", "user", user.ID, envelope{"role": role}, nil))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeUserAccess(w, r, http.StatusOK, user)
+}
+
+func (app *application) addUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePermissionCode(v, input.Code)
+	v.Check(!data.IsOrganizationPermission(input.Code), "code", "must be granted through an organization membership")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.PermisionModel.AddForUser(r.Context(), user.ID, input.Code)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "user.permission_add", "user", user.ID, nil, envelope{"permission": input.Code}))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddFieldError("code", "permission does not exist")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeUserAccess(w, r, http.StatusOK, user)
+}
+
+func (app *application) removeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+	err := app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.PermisionModel.RemoveForUser(r.Context(), user.ID, code)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "user.permission_remove", "user", user.ID, envelope{"permission": code}, nil))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeUserAccess(w, r, http.StatusOK, user)
+}
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.RoleModel.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.PermisionModel.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permisions{}
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePermissionCode(v, input.Code)
+	v.Check(!data.IsOrganizationPermission(input.Code), "code", "must be granted through an organization membership")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.PermisionModel.Insert(r.Context(), input.Code)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "permission.create", "permission", input.Code, nil, nil))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicatePermission):
+			v.AddFieldError("code", "a permission with this code already exists")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJson(w, http.StatusCreated, envelope{"permission": input.Code}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
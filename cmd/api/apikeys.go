@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/embracexyz/greenlight/internal/data"
+	"github.com/embracexyz/greenlight/internal/validator"
+)
+
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateAPIKeyName(v, input.Name); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	user := app.getContextUser(r)
+
+	// 明文key只在这里返回一次，数据库中只保存hash
+	var key *data.APIKey
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		key, err = m.APIKeyModel.New(r.Context(), user.ID, input.Name)
+		if err != nil {
+			return err
+		}
+		// 快照中不能包含明文key
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "apikey.create", "api_key", key.ID, nil, envelope{"name": key.Name, "prefix": key.Prefix}))
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getContextUser(r)
+
+	keys, err := app.models.APIKeyModel.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.getContextUser(r)
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.APIKeyModel.Delete(r.Context(), id, user.ID)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "apikey.delete", "api_key", id, nil, nil))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "api key revoked successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/data"
+	"github.com/embracexyz/greenlight/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// 构造一条审计记录，操作者默认为当前登录用户；before/after为修改前后的快照，没有时传nil
+func (app *application) newAuditEntry(r *http.Request, action, resourceType string, resourceID interface{}, before, after interface{}) *data.AuditEntry {
+	entry := &data.AuditEntry{
+		Action:       action,
+		ResourceType: resourceType,
+		Before:       before,
+		After:        after,
+		RequestID:    app.getContextRequestID(r),
+		ClientIP:     realip.FromRequest(r),
+	}
+	if resourceID != nil {
+		entry.ResourceID = fmt.Sprint(resourceID)
+	}
+
+	user, ok := r.Context().Value(userKey).(*data.User)
+	if ok && !user.IsAnonymous() {
+		entry.ActorID = user.ID
+	}
+	return entry
+}
+
+// 审计记录中的用户快照：audit_log不随账户删除，因此不包含邮箱，删除账户后不会留下邮箱明文
+func auditUser(user *data.User) envelope {
+	return envelope{"id": user.ID, "created_at": user.CreatedAt, "name": user.Name, "activated": user.Activated}
+}
+
+func (app *application) listAuditEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.AuditFilter
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+	input.ActorID = int64(app.readInt(qs, "actor_id", 0, v))
+	input.ResourceType = app.readString(qs, "resource_type", "")
+	input.ResourceID = app.readString(qs, "resource_id", "")
+	input.Action = app.readString(qs, "action", "")
+	input.From = app.readTime(qs, "from", time.Time{}, v)
+	input.To = app.readTime(qs, "to", time.Time{}, v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"id", "created_at", "-id", "-created_at"}
+
+	data.ValidateAuditFilter(v, input.AuditFilter)
+	if data.ValidateFilters(v, &input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	entries, metadata, err := app.models.AuditModel.GetAll(r.Context(), input.AuditFilter, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"audit": entries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
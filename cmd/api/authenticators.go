@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/data"
+	"github.com/embracexyz/greenlight/internal/keyring"
+	"github.com/embracexyz/greenlight/internal/validator"
+)
+
+// 一种认证方式：根据Authorization header中Bearer后的凭证找到对应用户
+// 凭证无效或找不到用户时返回ErrInvalidCredential或data.ErrRecordNotFound
+type authenticator interface {
+	// 凭证是否属于该认证方式，认证链中第一个匹配的authenticator负责认证
+	Match(credential string) bool
+	Authenticate(ctx context.Context, credential string) (*data.User, error)
+}
+
+// 按-auth-methods中的顺序构建认证链
+func newAuthenticators(methods []string, models data.Models, kr *keyring.Keyring, embedClaims bool) ([]authenticator, error) {
+	var authenticators []authenticator
+	for _, method := range methods {
+		switch method {
+		case "jwt":
+			authenticators = append(authenticators, jwtAuthenticator{keyring: kr, models: models, embedClaims: embedClaims})
+		case "token":
+			authenticators = append(authenticators, tokenAuthenticator{models: models})
+		case "apikey":
+			authenticators = append(authenticators, apiKeyAuthenticator{models: models})
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
+	}
+	if len(authenticators) == 0 {
+		return nil, errors.New("at least one authentication method must be enabled")
+	}
+	// 登录签发的access token是jwt或不透明token，两者都未启用时签发的token无法通过任何认证器
+	if !slices.Contains(methods, "jwt") && !slices.Contains(methods, "token") {
+		return nil, errors.New("jwt or token authentication must be enabled to verify issued access tokens")
+	}
+	return authenticators, nil
+}
+
+func (app *application) authenticate(ctx context.Context, credential string) (*data.User, error) {
+	for _, a := range app.authenticators {
+		if a.Match(credential) {
+			return a.Authenticate(ctx, credential)
+		}
+	}
+	return nil, ErrInvalidCredential
+}
+
+func (app *application) authMethodEnabled(method string) bool {
+	return validator.In(method, app.config.auth.methods...)
+}
+
+// 无状态的jwt，签名、有效期、issuer、audience以及token generation都通过才算有效
+type jwtAuthenticator struct {
+	keyring     *keyring.Keyring
+	models      data.Models
+	embedClaims bool
+}
+
+func (a jwtAuthenticator) Match(credential string) bool {
+	return strings.Count(credential, ".") == 2
+}
+
+func (a jwtAuthenticator) Authenticate(ctx context.Context, credential string) (*data.User, error) {
+	claims, err := a.keyring.Check([]byte(credential))
+	if err != nil {
+		return nil, ErrInvalidCredential
+	}
+
+	if !claims.Valid(time.Now()) {
+		return nil, ErrInvalidCredential
+	}
+
+	if claims.Issuer != "greenlight.xyz" {
+		return nil, ErrInvalidCredential
+	}
+
+	if !claims.AcceptAudience("greenlight.xyz") {
+		return nil, ErrInvalidCredential
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCredential
+	}
+
+	generation, ok := claims.Number("gen")
+	if !ok {
+		return nil, ErrInvalidCredential
+	}
+
+	var user *data.User
+	if a.embedClaims {
+		// 携带claims的jwt不查询数据库：user只有claims中的id、激活状态、权限和组织，需要完整资料的handler通过loadContextUser读取。
+		// 代价是登出、密码重置或refresh token被重放后，此前签发的jwt要到过期时才失效
+		activated, ok := claims.Set["act"].(bool)
+		if !ok {
+			return nil, ErrInvalidCredential
+		}
+		user = &data.User{ID: userID, Activated: activated, TokenGeneration: int(generation), FromClaims: true}
+	} else {
+		user, err = a.models.UserModel.Get(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		// 登出、密码重置或refresh token被重放后，用户的token generation会递增，此前签发的jwt随之失效
+		if int(generation) != user.TokenGeneration {
+			return nil, ErrInvalidCredential
+		}
+	}
+
+	// 登录时指定的组织，请求没有X-Organization-ID header时使用
+	if org, ok := claims.Number("org"); ok {
+		user.OrganizationID = int64(org)
+	}
+
+	// jwt中携带了权限列表时直接使用，requirePermission不再查询数据库
+	if a.embedClaims {
+		perms, ok := claims.Set["perms"].([]interface{})
+		if !ok {
+			return nil, ErrInvalidCredential
+		}
+		user.Permissions = make(data.Permisions, 0, len(perms))
+		for _, perm := range perms {
+			code, ok := perm.(string)
+			if !ok {
+				return nil, ErrInvalidCredential
+			}
+			user.Permissions = append(user.Permissions, code)
+		}
+	}
+
+	return user, nil
+}
+
+// 当前用户的完整资料（姓名、邮箱、密码、版本号等）；认证时已从数据库读取的直接返回，
+// 只由jwt claims构建的则在此读取，并校验token generation，登出或重置密码后此前签发的jwt不能再操作账户
+func (app *application) loadContextUser(r *http.Request) (*data.User, error) {
+	user := app.getContextUser(r)
+	if !user.FromClaims {
+		return user, nil
+	}
+
+	stored, err := app.models.UserModel.Get(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if stored.TokenGeneration != user.TokenGeneration {
+		return nil, ErrInvalidCredential
+	}
+	stored.Permissions = user.Permissions
+	stored.OrganizationID = user.OrganizationID
+	return stored, nil
+}
+
+func (app *application) loadContextUserErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidCredential), errors.Is(err, data.ErrRecordNotFound):
+		app.invalidAuthenticationTokenResponse(w, r)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 保存在tokens表中的不透明token
+type tokenAuthenticator struct {
+	models data.Models
+}
+
+func (a tokenAuthenticator) Match(credential string) bool {
+	return !data.IsAPIKey(credential) && !strings.Contains(credential, ".")
+}
+
+func (a tokenAuthenticator) Authenticate(ctx context.Context, credential string) (*data.User, error) {
+	v := validator.New()
+	if data.ValidatorToken(v, credential); !v.Valid() {
+		return nil, ErrInvalidCredential
+	}
+
+	return a.models.UserModel.GetForToken(ctx, data.ScopeAuthentication, credential)
+}
+
+// 给机器客户端使用的长期api key
+type apiKeyAuthenticator struct {
+	models data.Models
+}
+
+func (a apiKeyAuthenticator) Match(credential string) bool {
+	return data.IsAPIKey(credential)
+}
+
+func (a apiKeyAuthenticator) Authenticate(ctx context.Context, credential string) (*data.User, error) {
+	return a.models.APIKeyModel.GetUserForKey(ctx, credential)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/embracexyz/greenlight/internal/data"
+	"github.com/embracexyz/greenlight/internal/keyring"
+)
+
+func TestNewAuthenticators(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []string
+		wantErr bool
+	}{
+		{"jwt and api keys", []string{"jwt", "apikey"}, false},
+		{"opaque tokens", []string{"token"}, false},
+		{"all", []string{"apikey", "token", "jwt"}, false},
+		{"none", nil, true},
+		{"api keys only", []string{"apikey"}, true},
+		{"unknown", []string{"jwt", "basic"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newAuthenticators(tt.methods, data.NewMemoryModels(), keyring.New(), false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpaqueTokenAuthentication(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t, func(cfg *config) {
+		cfg.auth.methods = []string{"token"}
+	}))
+	user := ts.createUser(t, "Alice")
+
+	if strings.Contains(user.token, ".") || len(user.token) != 26 {
+		t.Fatalf("access token %q is not an opaque token", user.token)
+	}
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: user.token}, http.StatusOK)
+
+	// 只有jwt能携带组织
+	ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/authentication",
+		body:   map[string]interface{}{"email": user.email, "password": user.password, "organization_id": 1},
+	}, http.StatusUnprocessableEntity)
+
+	ts.expect(t, testRequest{method: http.MethodDelete, path: "/v1/tokens/authentication", token: user.token}, http.StatusOK)
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: user.token}, http.StatusUnauthorized)
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+	user := ts.createUser(t, "Alice")
+
+	res := ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/api-keys", token: user.token, body: map[string]string{"name": "ci"}}, http.StatusCreated)
+	key := jsonString(t, res.body, "api_key", "key")
+	id := jsonInt(t, res.body, "api_key", "id")
+
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: key}, http.StatusOK)
+
+	// 列表中不再返回明文
+	res = ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/api-keys", token: user.token}, http.StatusOK)
+	for _, k := range jsonValue(t, res.body, "api_keys").([]interface{}) {
+		if _, ok := k.(map[string]interface{})["key"]; ok {
+			t.Errorf("listed api key contains the plaintext: %v", k)
+		}
+	}
+
+	// 其他用户不能删除
+	other := ts.createUser(t, "Bob")
+	ts.expect(t, testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/api-keys/%d", id), token: other.token}, http.StatusNotFound)
+
+	ts.expect(t, testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/api-keys/%d", id), token: user.token}, http.StatusOK)
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: key}, http.StatusUnauthorized)
+}
+
+// jwt携带权限和组织时，鉴权使用jwt中的权限；需要完整资料的接口仍然校验token generation
+func TestEmbeddedClaims(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t, func(cfg *config) {
+		cfg.jwt.embedClaims = true
+	}))
+	owner := ts.createUser(t, "Owner")
+	viewer := ts.createUser(t, "Viewer")
+
+	res := ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/organizations", token: owner.token, body: map[string]string{"name": "Studio"}}, http.StatusCreated)
+	orgID := jsonInt(t, res.body, "organization", "id")
+	ts.expect(t, testRequest{
+		method: http.MethodPut,
+		path:   fmt.Sprintf("/v1/organizations/%d/members/%d", orgID, viewer.id),
+		token:  owner.token,
+		body:   map[string]string{"role": "viewer"},
+	}, http.StatusOK)
+
+	login := func(user testUser) string {
+		res := ts.expect(t, testRequest{
+			method: http.MethodPost,
+			path:   "/v1/tokens/authentication",
+			body:   map[string]interface{}{"email": user.email, "password": user.password, "organization_id": orgID},
+		}, http.StatusCreated)
+		return jsonString(t, res.body, "authentication_token")
+	}
+	ownerToken, viewerToken := login(owner), login(viewer)
+
+	movieID := ts.createMovie(t, testUser{token: ownerToken}, "Moana")
+	ts.expect(t, testRequest{method: http.MethodGet, path: fmt.Sprintf("/v1/movies/%d", movieID), token: viewerToken}, http.StatusOK)
+	ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/movies", token: viewerToken, body: testMovie("Up")}, http.StatusForbidden)
+
+	// 在一个组织中的角色不会带来其他组织中的电影权限
+	other := ts.createUser(t, "Other")
+	res = ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/organizations", token: other.token, body: map[string]string{"name": "Garage"}}, http.StatusCreated)
+	otherOrg := http.Header{"X-Organization-ID": {fmt.Sprint(jsonInt(t, res.body, "organization", "id"))}}
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/movies", token: viewerToken, header: otherOrg}, http.StatusForbidden)
+
+	res = ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: viewerToken}, http.StatusOK)
+	if jsonString(t, res.body, "user", "email") != viewer.email {
+		t.Errorf("user = %v, want the full profile", res.body["user"])
+	}
+
+	// 登出后，读取完整资料的接口立即拒绝此前签发的jwt
+	ts.expect(t, testRequest{method: http.MethodDelete, path: "/v1/tokens/authentication", token: viewerToken}, http.StatusOK)
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: viewerToken}, http.StatusUnauthorized)
+}
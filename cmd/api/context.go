@@ -9,7 +9,11 @@ import (
 
 type contextKey string
 
-const userKey contextKey = "user"
+const (
+	userKey       contextKey = "user"
+	requestIDKey  contextKey = "request_id"
+	membershipKey contextKey = "membership"
+)
 
 func (app *application) setContextUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userKey, user)
@@ -23,3 +27,34 @@ func (app *application) getContextUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+func (app *application) setContextRequestID(r *http.Request, requestID string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+	return r.WithContext(ctx)
+}
+
+func (app *application) getContextRequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDKey).(string)
+	return requestID
+}
+
+// 当前请求所在组织中的成员身份，由requireOrganization设置
+func (app *application) setContextMembership(r *http.Request, membership *data.Membership) *http.Request {
+	ctx := context.WithValue(r.Context(), membershipKey, membership)
+	return r.WithContext(ctx)
+}
+
+// 不在组织范围内的请求返回nil
+func (app *application) getContextMembership(r *http.Request) *data.Membership {
+	membership, _ := r.Context().Value(membershipKey).(*data.Membership)
+	return membership
+}
+
+// 当前请求所在的组织，必须在requireOrganization之后调用
+func (app *application) getContextOrganizationID(r *http.Request) int64 {
+	membership := app.getContextMembership(r)
+	if membership == nil {
+		panic("missing membership value in request context")
+	}
+	return membership.OrganizationID
+}
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 var (
-	ErrInvalidId = errors.New("invalid id parameter")
+	ErrInvalidId         = errors.New("invalid id parameter")
+	ErrInvalidCredential = errors.New("invalid authentication credential")
+
+	ErrInvalidOrganization  = errors.New("the X-Organization-ID header must be a positive integer")
+	ErrOrganizationRequired = errors.New("you belong to zero or several organizations, select one with the X-Organization-ID header")
+	ErrNotMember            = errors.New("not a member of the organization")
 )
 
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
+		"request_id":     app.getContextRequestID(r),
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
@@ -28,11 +38,29 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// 客户端断开或服务关闭取消了请求，查询随之中断，不属于服务端错误
+	if errors.Is(err, context.Canceled) || errors.Is(r.Context().Err(), context.Canceled) {
+		app.requestCanceledResponse(w, r, err)
+		return
+	}
+
 	app.logError(r, err)
 	message := "the server encounter a problem and could not process your request!"
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
 }
 
+func (app *application) requestCanceledResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logger.PrintInfo("request canceled", map[string]string{
+		"request_id":     app.getContextRequestID(r),
+		"request_method": r.Method,
+		"request_url":    r.URL.String(),
+		"error":          err.Error(),
+	})
+	// 客户端多半已经断开，响应只是尽力而为
+	message := "the request was canceled before it could be completed"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requestd resource could not be found!"
 	app.errorResponse(w, r, http.StatusNotFound, message)
@@ -61,6 +89,27 @@ func (app *application) rateLimmitExceededResponse(w http.ResponseWriter, r *htt
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+// 连续失败达到上限，账户暂时被锁定
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many failed attempts, this account is temporarily locked"
+	app.errorResponse(w, r, http.StatusLocked, message)
+}
+
+// 连续失败后的渐进延迟
+func (app *application) tooManyAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many failed attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// 发送邮件的接口超过了按账户的频率限制
+func (app *application) tooManySendsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many emails requested for this account, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -88,3 +137,13 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account does not have the necessary permissions to access"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) notMemberResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account is not a member of this organization"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) mfaEnrollmentRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account must enable two-factor authentication to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
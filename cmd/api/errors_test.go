@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestErrorResponses(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name     string
+		respond  func(w http.ResponseWriter, r *http.Request)
+		status   int
+		message  interface{}
+		header   string
+		headerTo string
+	}{
+		{
+			name:    "server error",
+			respond: func(w http.ResponseWriter, r *http.Request) { app.serverErrorResponse(w, r, errors.New("boom")) },
+			status:  http.StatusInternalServerError,
+			message: "the server encounter a problem and could not process your request!",
+		},
+		{
+			name:    "canceled request",
+			respond: func(w http.ResponseWriter, r *http.Request) { app.serverErrorResponse(w, r, context.Canceled) },
+			status:  http.StatusServiceUnavailable,
+			message: "the request was canceled before it could be completed",
+		},
+		{
+			name:    "not found",
+			respond: app.notFoundResponse,
+			status:  http.StatusNotFound,
+			message: "the requestd resource could not be found!",
+		},
+		{
+			name:    "method not allowed",
+			respond: app.methodNotAllowedResponse,
+			status:  http.StatusMethodNotAllowed,
+			message: "the GET method is not supported for this resource!",
+		},
+		{
+			name: "bad request",
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				app.badRequestErrorReponse(w, r, errors.New("body must not be empty"))
+			},
+			status:  http.StatusBadRequest,
+			message: "body must not be empty",
+		},
+		{
+			name: "failed validation",
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				app.failedValidationResponse(w, r, map[string]string{"title": "must be provided"})
+			},
+			status:  http.StatusUnprocessableEntity,
+			message: map[string]interface{}{"title": "must be provided"},
+		},
+		{
+			name:    "edit conflict",
+			respond: app.editConflictResponse,
+			status:  http.StatusConflict,
+			message: "unable to update the record due to an edit conflict, please try again",
+		},
+		{
+			name:    "rate limit exceeded",
+			respond: app.rateLimmitExceededResponse,
+			status:  http.StatusTooManyRequests,
+			message: "rate limit exceeded, Please try again later",
+		},
+		{
+			name:     "account locked",
+			respond:  func(w http.ResponseWriter, r *http.Request) { app.accountLockedResponse(w, r, 1500*time.Millisecond) },
+			status:   http.StatusLocked,
+			message:  "too many failed attempts, this account is temporarily locked",
+			header:   "Retry-After",
+			headerTo: "2",
+		},
+		{
+			name:     "too many attempts",
+			respond:  func(w http.ResponseWriter, r *http.Request) { app.tooManyAttemptsResponse(w, r, 30*time.Second) },
+			status:   http.StatusTooManyRequests,
+			message:  "too many failed attempts, please try again later",
+			header:   "Retry-After",
+			headerTo: "30",
+		},
+		{
+			name:     "too many sends",
+			respond:  func(w http.ResponseWriter, r *http.Request) { app.tooManySendsResponse(w, r, time.Hour) },
+			status:   http.StatusTooManyRequests,
+			message:  "too many emails requested for this account, please try again later",
+			header:   "Retry-After",
+			headerTo: "3600",
+		},
+		{
+			name:    "invalid credentials",
+			respond: app.invalidCredentialsResponse,
+			status:  http.StatusUnauthorized,
+			message: "invalid authentication credentials",
+		},
+		{
+			name:     "invalid authentication token",
+			respond:  app.invalidAuthenticationTokenResponse,
+			status:   http.StatusUnauthorized,
+			message:  "invalid or missing authentication token",
+			header:   "WWW-Authenticate",
+			headerTo: "Bearer",
+		},
+		{
+			name:    "authentication required",
+			respond: app.authenticationRequiredResponse,
+			status:  http.StatusUnauthorized,
+			message: "you must be authenticated to access this resource",
+		},
+		{
+			name:    "inactive account",
+			respond: app.inactiveAccountResponse,
+			status:  http.StatusForbidden,
+			message: "your user account must be activated to access this resource",
+		},
+		{
+			name:    "not permitted",
+			respond: app.notPermittedResponse,
+			status:  http.StatusForbidden,
+			message: "your user account does not have the necessary permissions to access",
+		},
+		{
+			name:    "not a member",
+			respond: app.notMemberResponse,
+			status:  http.StatusForbidden,
+			message: "your user account is not a member of this organization",
+		},
+		{
+			name:    "mfa enrollment required",
+			respond: app.mfaEnrollmentRequiredResponse,
+			status:  http.StatusForbidden,
+			message: "your user account must enable two-factor authentication to access this resource",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			tt.respond(rr, r)
+
+			if rr.Code != tt.status {
+				t.Errorf("status = %d, want %d", rr.Code, tt.status)
+			}
+			if got := rr.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			if tt.header != "" && rr.Header().Get(tt.header) != tt.headerTo {
+				t.Errorf("%s = %q, want %q", tt.header, rr.Header().Get(tt.header), tt.headerTo)
+			}
+
+			var body map[string]interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(body["error"])
+			want, _ := json.Marshal(tt.message)
+			if string(got) != string(want) {
+				t.Errorf("error = %s, want %s", got, want)
+			}
+		})
+	}
+}
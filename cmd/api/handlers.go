@@ -12,8 +12,7 @@ import (
 
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		data.MovieFilter
 		data.Filters
 	}
 
@@ -21,20 +20,56 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	input.Title = app.readString(r.URL.Query(), "title", "")
 	input.Genres = app.readCSV(r.URL.Query(), "genres", []string{})
+	input.CreatedBy = int64(app.readInt(r.URL.Query(), "created_by", 0, v))
+	input.GenresAny = app.readCSV(r.URL.Query(), "genres_any", []string{})
+	input.GenresNone = app.readCSV(r.URL.Query(), "genres_none", []string{})
+	input.YearMin = int32(app.readInt(r.URL.Query(), "year_min", 0, v))
+	input.YearMax = int32(app.readInt(r.URL.Query(), "year_max", 0, v))
+	input.RuntimeMin = data.Runtime(app.readInt(r.URL.Query(), "runtime_min", 0, v))
+	input.RuntimeMax = data.Runtime(app.readInt(r.URL.Query(), "runtime_max", 0, v))
+	input.CreatedAfter = app.readTime(r.URL.Query(), "created_after", time.Time{}, v)
+	input.CreatedBefore = app.readTime(r.URL.Query(), "created_before", time.Time{}, v)
+	input.IDs = app.readInt64CSV(r.URL.Query(), "ids", v)
+	// 全文搜索，默认按相关度排序
+	input.Search = app.readString(r.URL.Query(), "q", "")
+	input.Language = app.readString(r.URL.Query(), "language", data.DefaultSearchLanguage)
+	// 分面统计，例如facets=genres,decade,runtime，结果在metadata.facets中
+	input.Facets = app.readCSV(r.URL.Query(), "facets", []string{})
 	input.Filters.Page = app.readInt(r.URL.Query(), "page", 1, v)
 	input.Filters.PageSize = app.readInt(r.URL.Query(), "page_size", 20, v)
 
 	input.Filters.Sort = app.readString(r.URL.Query(), "sort", "id")
 	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
-
+	if input.Search != "" {
+		input.Filters.Sort = app.readString(r.URL.Query(), "sort", "relevance")
+		input.Filters.SortSafelist = append(input.Filters.SortSafelist, "relevance")
+	}
+	// 游标分页：after/before为上一次响应metadata中的next_cursor/prev_cursor
+	input.Filters.After = app.readString(r.URL.Query(), "after", "")
+	input.Filters.Before = app.readString(r.URL.Query(), "before", "")
+	// 总数：页码分页默认计算，游标分页默认不计算，count=true时才计算
+	count := app.readBool(r.URL.Query(), "count", input.Filters.After == "" && input.Filters.Before == "", v)
+	input.Filters.SkipCount, input.Filters.CountCursor = !count, count
+
+	data.ValidateMovieFilter(v, input.MovieFilter)
 	if data.ValidateFilters(v, &input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.FieldErrors)
 		return
 	}
 
-	movies, metadata, err := app.models.MovieModel.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.MovieModel.GetAll(r.Context(), app.getContextOrganizationID(r), input.MovieFilter, input.Filters)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrCursorMismatch):
+			key := "after"
+			if input.Filters.Before != "" {
+				key = "before"
+			}
+			v.AddFieldError(key, "was issued for different filters")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 	err = app.writeJson(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
@@ -43,6 +78,34 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// 标题的自动补全，结果可以在客户端短暂缓存
+func (app *application) suggestMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	q := app.readString(r.URL.Query(), "q", "")
+	limit := app.readInt(r.URL.Query(), "limit", 10, v)
+
+	if data.ValidateSuggestion(v, q, limit); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	suggestions, err := app.models.MovieModel.Suggest(r.Context(), app.getContextOrganizationID(r), q, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// 结果因用户（组织）而异，只允许客户端缓存；Vary由认证和组织中间件设置
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "private, max-age=60")
+
+	err = app.writeJson(w, http.StatusOK, envelope{"suggestions": suggestions}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
@@ -50,7 +113,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movie, err := app.models.MovieModel.Get(id)
+	movie, err := app.models.MovieModel.Get(r.Context(), app.getContextOrganizationID(r), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -69,10 +132,13 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		Title       string       `json:"title"`
+		Year        int32        `json:"year"`
+		Runtime     data.Runtime `json:"runtime"`
+		Genres      []string     `json:"genres"`
+		Description string       `json:"description"`
+		Plot        string       `json:"plot"`
+		Language    string       `json:"language"`
 	}
 
 	err := app.readJson(w, r, &input)
@@ -84,18 +150,32 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// valid request
 	v := validator.New()
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:          input.Title,
+		Year:           input.Year,
+		Runtime:        input.Runtime,
+		Genres:         input.Genres,
+		Description:    input.Description,
+		Plot:           input.Plot,
+		Language:       input.Language,
+		CreatedBy:      app.getContextUser(r).ID,
+		OrganizationID: app.getContextOrganizationID(r),
+	}
+	if movie.Language == "" {
+		movie.Language = data.DefaultSearchLanguage
 	}
 	if data.ValidateMove(v, movie); !v.Valid() {
 		app.failedValidationResponse(w, r, v.FieldErrors)
 		return
 	}
 
-	// insert
-	err = app.models.MovieModel.Insert(movie)
+	// insert，与审计记录在同一个事务中写入
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.MovieModel.Insert(r.Context(), movie)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "movie.create", "movie", movie.ID, nil, movie))
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -118,7 +198,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// 2. 查询id是否真实存在，否则return nodFound
-	movie, err := app.models.MovieModel.Get(id)
+	movie, err := app.models.MovieModel.Get(r.Context(), app.getContextOrganizationID(r), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -129,12 +209,30 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	before := *movie
+
+	// 只有movies:write:own权限时，只能修改自己创建的电影
+	user := app.getContextUser(r)
+	allowed, err := app.authorizeOwned(r, "movies:write", movie.CreatedBy)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	movie.UpdatedBy = user.ID
+
 	// 3. 把更新的值，覆盖从数据库查询的字段（其他字段保留）
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		Title       string       `json:"title"`
+		Year        int32        `json:"year"`
+		Runtime     data.Runtime `json:"runtime"`
+		Genres      []string     `json:"genres"`
+		Description string       `json:"description"`
+		Plot        string       `json:"plot"`
+		Language    string       `json:"language"`
 	}
 
 	err = app.readJson(w, r, &input)
@@ -147,6 +245,12 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	movie.Year = input.Year
 	movie.Runtime = input.Runtime
 	movie.Genres = input.Genres
+	movie.Description = input.Description
+	movie.Plot = input.Plot
+	movie.Language = input.Language
+	if movie.Language == "" {
+		movie.Language = data.DefaultSearchLanguage
+	}
 
 	// 4. validatror严重，否则return， baserequest
 	v := validator.New()
@@ -156,7 +260,16 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// 5. 更新，err则判断err类型，返回对应响应，happy path则write更新后的json
-	err = app.models.MovieModel.Update(movie)
+	// 事务重试时从原来的版本号重新开始
+	version := movie.Version
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		movie.Version = version
+		err := m.MovieModel.Update(r.Context(), movie)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "movie.update", "movie", movie.ID, before, movie))
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -181,7 +294,34 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.MovieModel.Delete(id)
+	movie, err := app.models.MovieModel.Get(r.Context(), app.getContextOrganizationID(r), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	allowed, err := app.authorizeOwned(r, "movies:write", movie.CreatedBy)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.MovieModel.Delete(r.Context(), movie.OrganizationID, id)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "movie.delete", "movie", id, movie, nil))
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -208,7 +348,7 @@ func (app *application) partialUpdateMovieHandler(w http.ResponseWriter, r *http
 	}
 
 	// 2. 查询id是否真实存在，否则return nodFound
-	movie, err := app.models.MovieModel.Get(id)
+	movie, err := app.models.MovieModel.Get(r.Context(), app.getContextOrganizationID(r), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -219,14 +359,32 @@ func (app *application) partialUpdateMovieHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	before := *movie
+
+	// 只有movies:write:own权限时，只能修改自己创建的电影
+	user := app.getContextUser(r)
+	allowed, err := app.authorizeOwned(r, "movies:write", movie.CreatedBy)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	movie.UpdatedBy = user.ID
+
 	// 3. 把更新的值，覆盖从数据库查询的字段（其他字段保留）
 	// ! 把值类型改为其指针，这样json解析时，没传值的就会保持为nil，根据是否为nil可判断客户端是否传值，只针对传值的字段进行覆盖更新，实现partialUpdate的效果
 	//		如果是"key": null，默认json解析器也会忽略该值，认为没传；另注意"key": ""，是传值了，值是空字符串
 	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
+		Title       *string       `json:"title"`
+		Year        *int32        `json:"year"`
+		Runtime     *data.Runtime `json:"runtime"`
+		Genres      []string      `json:"genres"`
+		Description *string       `json:"description"`
+		Plot        *string       `json:"plot"`
+		Language    *string       `json:"language"`
 	}
 
 	err = app.readJson(w, r, &input)
@@ -247,6 +405,15 @@ func (app *application) partialUpdateMovieHandler(w http.ResponseWriter, r *http
 	if input.Genres != nil {
 		movie.Genres = input.Genres
 	}
+	if input.Description != nil {
+		movie.Description = *input.Description
+	}
+	if input.Plot != nil {
+		movie.Plot = *input.Plot
+	}
+	if input.Language != nil {
+		movie.Language = *input.Language
+	}
 
 	// 4. validatror严重，否则return， baserequest
 	v := validator.New()
@@ -256,7 +423,15 @@ func (app *application) partialUpdateMovieHandler(w http.ResponseWriter, r *http
 	}
 
 	// 5. 更新，err则判断err类型，返回对应响应，happy path则write更新后的json
-	err = app.models.MovieModel.Update(movie)
+	version := movie.Version
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		movie.Version = version
+		err := m.MovieModel.Update(r.Context(), movie)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "movie.update", "movie", movie.ID, before, movie))
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -294,20 +469,49 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Activated: false,
 	}
 
+	// 先校验明文：超过当前算法长度上限的密码无法哈希
+	v := validator.New()
+	if data.ValidPasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
 	err = user.Password.Set(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	v := validator.New()
 	if data.ValidatorUser(v, user); !v.Valid() {
 		app.failedValidationResponse(w, r, v.FieldErrors)
 		return
 	}
 
-	// insert
-	err = app.models.UserModel.Insert(user)
+	// insert，用户、个人组织、激活token以及审计记录在同一个事务中写入
+	var token *data.Token
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.UserModel.Insert(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		// 电影的权限只来自组织内的角色，新用户成为自己个人组织的owner
+		org := &data.Organization{Name: data.PersonalOrganizationName}
+		err = m.OrganizationModel.Insert(r.Context(), org, user.ID)
+		if err != nil {
+			return err
+		}
+
+		// generate token
+		token, err = m.TokenModel.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+
+		entry := app.newAuditEntry(r, "user.create", "user", user.ID, nil, auditUser(user))
+		entry.ActorID = user.ID
+		return m.AuditModel.Insert(r.Context(), entry)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -319,21 +523,6 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// init default permission
-	err = app.models.PermisionModel.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// response
-	// generate token
-	token, err := app.models.TokenModel.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
 	app.Background(func() {
 		data := map[string]interface{}{
 			"activationToken": token.Plaintext,
@@ -343,7 +532,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 			"email": user.Email,
 			"token": token.Plaintext,
 		})
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		err := app.mailer.Send(user.Email, "user_welcome.tmpl", data)
 		if err != nil {
 			app.logger.PrintError(err, nil)
 		}
@@ -368,12 +557,12 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	v := validator.New()
-	if data.ValidPasswordPlaintext(v, input.TokenPlaintext); !v.Valid() {
+	if data.ValidatorToken(v, input.TokenPlaintext); !v.Valid() {
 		app.failedValidationResponse(w, r, v.FieldErrors)
 		return
 	}
 
-	user, err := app.models.UserModel.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.UserModel.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -386,9 +575,27 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// find user, then update activate filed
+	before := *user
 	user.Activated = true
 
-	err = app.models.UserModel.Update(user)
+	version := user.Version
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		user.Version = version
+		err := m.UserModel.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		// clean token
+		err = m.TokenModel.DeleteAllForUser(r.Context(), data.ScopeActivation, user.ID)
+		if err != nil {
+			return err
+		}
+
+		entry := app.newAuditEntry(r, "user.activate", "user", user.ID, auditUser(&before), auditUser(user))
+		entry.ActorID = user.ID
+		return m.AuditModel.Insert(r.Context(), entry)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -399,13 +606,6 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// clean token
-	err = app.models.TokenModel.DeleteAllForUser(data.ScopeActivation, user.ID)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
 	err = app.writeJson(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -432,11 +632,12 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	user, err := app.models.UserModel.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	user, err := app.models.UserModel.GetForToken(r.Context(), data.ScopePasswordReset, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddFieldError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.FieldErrors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -449,7 +650,35 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	err = app.models.UserModel.Update(user)
+	version := user.Version
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		user.Version = version
+		err := m.UserModel.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		err = m.TokenModel.DeleteAllForUser(r.Context(), data.ScopePasswordReset, user.ID)
+		if err != nil {
+			return err
+		}
+
+		// 修改密码前发出的magic link同样作废
+		err = m.TokenModel.DeleteAllForUser(r.Context(), data.ScopeMagicLink, user.ID)
+		if err != nil {
+			return err
+		}
+
+		// 密码重置后，已登录的会话全部失效
+		err = app.revokeUserSessions(r.Context(), m, user.ID)
+		if err != nil {
+			return err
+		}
+
+		entry := app.newAuditEntry(r, "user.password_reset", "user", user.ID, nil, nil)
+		entry.ActorID = user.ID
+		return m.AuditModel.Insert(r.Context(), entry)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -460,7 +689,8 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	err = app.models.TokenModel.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	// 通过邮箱重置密码同时解除账户的登录锁定
+	err = app.clearFailedAttempts(r.Context(), emailAttemptKey("login", user.Email), mfaAttemptKey(user.ID))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
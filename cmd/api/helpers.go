@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/embracexyz/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
@@ -102,6 +103,35 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return valInt
 }
 
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	val := qs.Get(key)
+	if val == "" {
+		return defaultValue
+	}
+
+	valBool, err := strconv.ParseBool(val)
+	if err != nil {
+		v.AddFieldError(key, "must be a boolean value")
+		return defaultValue
+	}
+	return valBool
+}
+
+// RFC3339格式的时间
+func (app *application) readTime(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	val := qs.Get(key)
+	if val == "" {
+		return defaultValue
+	}
+
+	valTime, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		v.AddFieldError(key, "must be an RFC3339 timestamp")
+		return defaultValue
+	}
+	return valTime
+}
+
 func (app *application) readCSV(qs url.Values, key string, defaultValue []string) []string {
 	val := qs.Get(key)
 	if val == "" {
@@ -111,6 +141,20 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 	return splitValue
 }
 
+// 逗号分隔的整数列表，例如ids=1,2,3
+func (app *application) readInt64CSV(qs url.Values, key string, v *validator.Validator) []int64 {
+	values := []int64{}
+	for _, val := range app.readCSV(qs, key, []string{}) {
+		valInt, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			v.AddFieldError(key, "must be a comma-separated list of integers")
+			return nil
+		}
+		values = append(values, valInt)
+	}
+	return values
+}
+
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
 	val := qs.Get(key)
 	if val == "" {
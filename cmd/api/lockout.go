@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/data"
+)
+
+// 失败尝试按账户计数，不同的动作使用不同的key，互不影响
+func emailAttemptKey(action, email string) string {
+	return action + ":" + strings.ToLower(email)
+}
+
+func mfaAttemptKey(userID int64) string {
+	return "mfa:" + strconv.FormatInt(userID, 10)
+}
+
+// 检查key是否处于锁定或延迟中，是则直接写入423/429响应并返回false
+func (app *application) checkLockout(w http.ResponseWriter, r *http.Request, key string) bool {
+	if !app.config.lockout.enabled {
+		return true
+	}
+
+	attempts, err := app.models.AttemptModel.Get(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return true
+		default:
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+	}
+
+	now := time.Now()
+	if !attempts.Locked(now) {
+		return true
+	}
+
+	retryAfter := attempts.LockedUntil.Sub(now)
+	if attempts.Failures >= app.config.lockout.policy.MaxFailures {
+		app.accountLockedResponse(w, r, retryAfter)
+	} else {
+		app.tooManyAttemptsResponse(w, r, retryAfter)
+	}
+	return false
+}
+
+func (app *application) recordFailedAttempt(ctx context.Context, key string) error {
+	if !app.config.lockout.enabled {
+		return nil
+	}
+
+	attempts, err := app.models.AttemptModel.RecordFailure(ctx, key, app.config.lockout.policy)
+	if err != nil {
+		return err
+	}
+
+	if attempts.Failures == app.config.lockout.policy.MaxFailures {
+		app.logger.PrintWarning("account locked after repeated failures", map[string]string{
+			"key":          key,
+			"locked_until": attempts.LockedUntil.Format(time.RFC3339),
+		})
+	}
+	return nil
+}
+
+func (app *application) clearFailedAttempts(ctx context.Context, keys ...string) error {
+	if !app.config.lockout.enabled {
+		return nil
+	}
+
+	for _, key := range keys {
+		err := app.models.AttemptModel.Clear(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 记录一次失败后返回401
+func (app *application) failedLoginResponse(w http.ResponseWriter, r *http.Request, key string) {
+	err := app.recordFailedAttempt(r.Context(), key)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.invalidCredentialsResponse(w, r)
+}
+
+// 发送邮件的接口按账户限制频率，超过上限时直接写入429响应并返回false；
+// 与失败尝试分开计数，不会锁定账户，也不影响登录
+func (app *application) limitSends(w http.ResponseWriter, r *http.Request, key string) bool {
+	limit := app.config.sendLimit
+	if limit.Max <= 0 {
+		return true
+	}
+
+	attempts, err := app.models.AttemptModel.RecordSend(r.Context(), key, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if attempts.Failures <= limit.Max {
+		return true
+	}
+
+	app.tooManySendsResponse(w, r, time.Until(attempts.LastFailureAt.Add(limit.Window)))
+	return false
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
@@ -17,6 +19,7 @@ import (
 
 	"github.com/embracexyz/greenlight/internal/data"
 	"github.com/embracexyz/greenlight/internal/jsonlog"
+	"github.com/embracexyz/greenlight/internal/keyring"
 	"github.com/embracexyz/greenlight/internal/mailer"
 )
 
@@ -26,11 +29,15 @@ var buildTime string
 type config struct {
 	port int
 	env  string
-	db   struct {
+	// 数据存储：postgres，或者只用于测试和本地演示的memory
+	storage string
+	db      struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		// 每条查询的默认超时，叠加在请求的context之上
+		queryTimeout time.Duration
 	}
 	limiter struct {
 		rps     float64
@@ -48,16 +55,73 @@ type config struct {
 		trustedOrigins []string
 	}
 	jwt struct {
-		secret string
+		secret     string
+		keyFiles   map[string]string
+		activeKID  string
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+		// 在jwt中携带权限列表和激活状态，校验权限时不再查询数据库
+		embedClaims bool
 	}
+	auth struct {
+		methods []string
+	}
+	mfa struct {
+		enforceWriters bool
+	}
+	lockout struct {
+		enabled bool
+		policy  data.LockoutPolicy
+	}
+	password struct {
+		params        data.PasswordParams
+		targetLatency time.Duration
+	}
+	cache struct {
+		ttl time.Duration
+	}
+	// 游标分页的签名密钥，多个实例之间需要一致
+	cursorSecret string
+	// 发送邮件的接口（密码重置、激活、登录链接）按账户限制频率，与失败锁定分开
+	sendLimit data.SendLimit
 }
 
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config         config
+	logger         *jsonlog.Logger
+	models         data.Models
+	mailer         mailSender
+	keyring        *keyring.Keyring
+	authenticators []authenticator
+	wg             sync.WaitGroup
+}
+
+// 发送邮件，生产环境为mailer.Mailer，测试时可以替换为记录邮件内容的实现
+type mailSender interface {
+	Send(recipient, templateFile string, data interface{}) error
+}
+
+// 根据配置构造application：加载jwt密钥并创建认证器；models和mailer由调用方决定，
+// 因此可以使用内存存储和不实际发送的mailer构造出完整的application
+func newApplication(cfg config, logger *jsonlog.Logger, models data.Models, mailer mailSender) (*application, error) {
+	kr, err := openKeyring(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticators, err := newAuthenticators(cfg.auth.methods, models, kr, cfg.jwt.embedClaims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &application{
+		config:         cfg,
+		logger:         logger,
+		models:         models,
+		mailer:         mailer,
+		keyring:        kr,
+		authenticators: authenticators,
+	}, nil
 }
 
 func openDB(cfg config) (*sql.DB, error) {
@@ -87,16 +151,60 @@ func openDB(cfg config) (*sql.DB, error) {
 	return db, nil
 }
 
+// -jwt-secret作为kid为"default"的HS256密钥；-jwt-keys中的PEM文件为EdDSA/RS256密钥，其余文件内容作为HS256 secret
+func openKeyring(cfg config) (*keyring.Keyring, error) {
+	kr := keyring.New()
+
+	activeKID := cfg.jwt.activeKID
+	if cfg.jwt.secret != "" {
+		err := kr.AddHMAC("default", []byte(cfg.jwt.secret))
+		if err != nil {
+			return nil, err
+		}
+		if activeKID == "" {
+			activeKID = "default"
+		}
+	}
+
+	for kid, path := range cfg.jwt.keyFiles {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.Contains(string(content), "-----BEGIN") {
+			err = kr.AddPEM(kid, content)
+		} else {
+			err = kr.AddHMAC(kid, bytes.TrimSpace(content))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if activeKID == "" {
+		return nil, errors.New("no active jwt signing key, set -jwt-secret or -jwt-active-kid")
+	}
+	err := kr.SetActive(activeKID)
+	if err != nil {
+		return nil, err
+	}
+
+	return kr, nil
+}
+
 func main() {
 	// 处理传参，构建config
 	var cfg config
 	flag.IntVar(&cfg.port, "port", 4000, "Server port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application environment {development|production}")
 
+	flag.StringVar(&cfg.storage, "storage", "postgres", "Storage backend {postgres|memory}")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "Default timeout of a single PostgreSQL query")
 
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
@@ -118,6 +226,61 @@ func main() {
 	})
 
 	flag.StringVar(&cfg.jwt.secret, "jwt-secret", "", "jwt-secret")
+	flag.Func("jwt-keys", "JWT keys as kid=path pairs (space separated)", func(s string) error {
+		cfg.jwt.keyFiles = make(map[string]string)
+		for _, pair := range strings.Fields(s) {
+			kid, path, ok := strings.Cut(pair, "=")
+			if !ok || kid == "" || path == "" {
+				return fmt.Errorf("invalid jwt key %q, expected kid=path", pair)
+			}
+			cfg.jwt.keyFiles[kid] = path
+		}
+		return nil
+	})
+	flag.StringVar(&cfg.jwt.activeKID, "jwt-active-kid", "", "Key ID used to sign new JWTs")
+
+	cfg.auth.methods = []string{"jwt", "apikey"}
+	flag.Func("auth-methods", "Enabled authentication methods in order {jwt|token|apikey} (space separated, default \"jwt apikey\")", func(s string) error {
+		cfg.auth.methods = strings.Fields(s)
+		return nil
+	})
+	flag.DurationVar(&cfg.jwt.accessTTL, "jwt-access-ttl", 15*time.Minute, "Lifetime of JWT access tokens")
+	flag.DurationVar(&cfg.jwt.refreshTTL, "jwt-refresh-ttl", 7*24*time.Hour, "Lifetime of refresh tokens")
+	flag.BoolVar(&cfg.jwt.embedClaims, "jwt-embed-claims", false, "Embed permissions and activation status in JWTs and authenticate them without a database lookup (permission changes and session revocation apply when the access token expires)")
+
+	flag.StringVar(&cfg.cursorSecret, "cursor-secret", os.Getenv("GREENLIGHT_CURSOR_SECRET"), "Secret for signing pagination cursors (random per process if empty)")
+	flag.DurationVar(&cfg.cache.ttl, "cache-ttl", 30*time.Second, "TTL of the in-process user and permission cache (0 disables)")
+
+	flag.BoolVar(&cfg.lockout.enabled, "lockout-enabled", true, "Enable per-account lockout after failed attempts")
+	flag.IntVar(&cfg.lockout.policy.DelayAfter, "lockout-delay-after", 3, "Failed attempts before progressive delays start")
+	flag.DurationVar(&cfg.lockout.policy.BaseDelay, "lockout-base-delay", time.Second, "First progressive delay, doubled on each further failure")
+	flag.IntVar(&cfg.lockout.policy.MaxFailures, "lockout-max-failures", 10, "Failed attempts before the account is locked")
+	flag.DurationVar(&cfg.lockout.policy.Duration, "lockout-duration", 15*time.Minute, "Account lockout duration")
+	flag.DurationVar(&cfg.lockout.policy.Window, "lockout-window", 15*time.Minute, "Failed attempts older than this are forgotten")
+	flag.IntVar(&cfg.sendLimit.Max, "send-limit-max", 5, "Emails an account can request per window (0 = unlimited)")
+	flag.DurationVar(&cfg.sendLimit.Window, "send-limit-window", time.Hour, "Window for the per-account email send limit")
+
+	cfg.password.params = data.DefaultPasswordParams
+	flag.StringVar(&cfg.password.params.Algorithm, "password-algorithm", data.DefaultPasswordParams.Algorithm, "Algorithm for new password hashes {argon2id|bcrypt}")
+	flag.IntVar(&cfg.password.params.BcryptCost, "password-bcrypt-cost", data.DefaultPasswordParams.BcryptCost, "bcrypt cost")
+	flag.Func("password-argon2-time", "argon2id iterations (default 1)", func(s string) error {
+		n, err := strconv.ParseUint(s, 10, 32)
+		cfg.password.params.Argon2Time = uint32(n)
+		return err
+	})
+	flag.Func("password-argon2-memory", "argon2id memory in KiB (default 65536)", func(s string) error {
+		n, err := strconv.ParseUint(s, 10, 32)
+		cfg.password.params.Argon2Memory = uint32(n)
+		return err
+	})
+	flag.Func("password-argon2-threads", "argon2id parallelism (default 4)", func(s string) error {
+		n, err := strconv.ParseUint(s, 10, 8)
+		cfg.password.params.Argon2Threads = uint8(n)
+		return err
+	})
+	flag.DurationVar(&cfg.password.targetLatency, "password-target-latency", 0, "Raise password hash cost at startup until one hash takes at least this long (0 disables)")
+
+	flag.BoolVar(&cfg.mfa.enforceWriters, "mfa-enforce-writers", false, "Require accounts with movies:write to enable two-factor authentication")
 
 	var displayVersion bool
 	flag.BoolVar(&displayVersion, "version", false, "Display version and exit")
@@ -131,34 +294,78 @@ func main() {
 	}
 	logger := jsonlog.New(os.Stdout, jsonlog.INFO)
 
-	// conn db
-	db, err := openDB(cfg)
+	if cfg.db.queryTimeout <= 0 {
+		logger.PrintFatal(errors.New("-db-query-timeout must be positive"), nil)
+	}
+	data.SetQueryTimeout(cfg.db.queryTimeout)
+	if cfg.cursorSecret != "" {
+		data.SetCursorSecret(cfg.cursorSecret)
+	}
+
+	var models data.Models
+	switch cfg.storage {
+	case "postgres":
+		// conn db
+		db, err := openDB(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		defer db.Close()
+		logger.PrintInfo("database connection pool established", nil)
+
+		models = data.NewModels(db)
+		if cfg.cache.ttl > 0 {
+			models = data.NewCachedModels(models, cfg.cache.ttl)
+		}
+
+		expvar.Publish("database", expvar.Func(func() interface{} {
+			return db.Stats()
+		}))
+	case "memory":
+		// 数据只保存在进程内，不需要再加缓存
+		models = data.NewMemoryModels()
+		logger.PrintInfo("using in-memory storage, data will be lost on exit", nil)
+	default:
+		logger.PrintFatal(fmt.Errorf("invalid -storage %q, must be postgres or memory", cfg.storage), nil)
+	}
+
+	// 启动时测量哈希耗时，按需提高参数以达到目标的登录延迟
+	params, elapsed, err := data.BenchmarkPasswordParams(cfg.password.params, cfg.password.targetLatency)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	err = data.SetPasswordParams(params)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	logger.PrintInfo("password hasher configured", map[string]string{
+		"algorithm":      params.Algorithm,
+		"bcrypt_cost":    strconv.Itoa(params.BcryptCost),
+		"argon2_time":    strconv.FormatUint(uint64(params.Argon2Time), 10),
+		"argon2_memory":  strconv.FormatUint(uint64(params.Argon2Memory), 10),
+		"argon2_threads": strconv.FormatUint(uint64(params.Argon2Threads), 10),
+		"hash_duration":  elapsed.String(),
+	})
+
+	// 构造application实例
+	app, err := newApplication(cfg, logger, models, mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.user, cfg.smtp.pass, cfg.smtp.sender))
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
-	defer db.Close()
-	logger.PrintInfo("database connection pool established", nil)
+	logger.PrintInfo("jwt keyring loaded", map[string]string{
+		"active_kid": app.keyring.Active().ID,
+		"algorithm":  app.keyring.Active().Algorithm,
+	})
 
 	// metric
 	expvar.NewString("version").Set(version)
 	expvar.Publish("goroutines", expvar.Func(func() interface{} {
 		return runtime.NumGoroutine()
 	}))
-	expvar.Publish("database", expvar.Func(func() interface{} {
-		return db.Stats()
-	}))
 	expvar.Publish("timestamp", expvar.Func(func() interface{} {
 		return time.Now().Unix()
 	}))
 
-	// 构造application实例
-	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.user, cfg.smtp.pass, cfg.smtp.sender),
-	}
-
 	err = app.serve()
 	if err != nil {
 		logger.PrintFatal(err, nil)
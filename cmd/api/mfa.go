@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/data"
+	"github.com/embracexyz/greenlight/internal/totp"
+	"github.com/embracexyz/greenlight/internal/validator"
+)
+
+const (
+	mfaPendingTTL     = 5 * time.Minute
+	recoveryCodeTTL   = 10 * 365 * 24 * time.Hour
+	recoveryCodeCount = 10
+)
+
+// 用户是否已经启用（登记并确认）两步验证
+func (app *application) mfaEnabled(ctx context.Context, userID int64) (bool, error) {
+	secret, err := app.models.TOTPModel.Get(ctx, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return secret.Confirmed, nil
+}
+
+// 校验验证码并记录其时间窗口，防止同一个验证码被重放
+func (app *application) verifyTOTP(ctx context.Context, secret *data.TOTP, code string) (bool, error) {
+	step, ok := totp.Validate(secret.Secret, code, time.Now())
+	if !ok || step <= secret.LastStep {
+		return false, nil
+	}
+
+	err := app.models.TOTPModel.Use(ctx, secret.UserID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// 登记TOTP secret，返回secret以及供客户端生成二维码的otpauth uri
+func (app *application) createTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadContextUser(r)
+	if err != nil {
+		app.loadContextUserErrorResponse(w, r, err)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	t := &data.TOTP{
+		UserID: user.ID,
+		Secret: secret,
+	}
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.TOTPModel.Insert(r.Context(), t)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "user.totp_enroll", "user", user.ID, nil, nil))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v := validator.New()
+			v.AddFieldError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	message := envelope{
+		"totp": map[string]string{
+			"secret":      secret,
+			"otpauth_uri": totp.URI("Greenlight", user.Email, secret),
+		},
+	}
+	err = app.writeJson(w, http.StatusCreated, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 使用验证码确认登记的secret，启用两步验证并返回一次性的恢复码
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	user := app.getContextUser(r)
+
+	secret, err := app.models.TOTPModel.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddFieldError("totp", "two-factor authentication has not been enrolled")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if secret.Confirmed {
+		v.AddFieldError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	ok, err := app.verifyTOTP(r.Context(), secret, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddFieldError("code", "invalid or expired code")
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	// 生成新的恢复码，明文只返回这一次
+	codes := make([]string, 0, recoveryCodeCount)
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		// 事务重试时重新生成
+		codes = codes[:0]
+		err := m.TokenModel.DeleteAllForUser(r.Context(), data.ScopeMFARecovery, user.ID)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < recoveryCodeCount; i++ {
+			token, err := m.TokenModel.New(r.Context(), user.ID, recoveryCodeTTL, data.ScopeMFARecovery)
+			if err != nil {
+				return err
+			}
+			codes = append(codes, token.Plaintext)
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "user.totp_enable", "user", user.ID, nil, nil))
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 关闭两步验证，需要提供当前的验证码
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	user := app.getContextUser(r)
+
+	secret, err := app.models.TOTPModel.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.verifyTOTP(r.Context(), secret, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddFieldError("code", "invalid or expired code")
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.TOTPModel.Delete(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = m.TokenModel.DeleteAllForUser(r.Context(), data.ScopeMFARecovery, user.ID)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "user.totp_disable", "user", user.ID, nil, nil))
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 两步验证的第二步：用mfa-pending token加上验证码或恢复码换取真正的access token
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken       string `json:"mfa_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+		OrganizationID int64  `json:"organization_id"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.MFAToken != "", "mfa_token", "must be provided")
+	if input.RecoveryCode == "" {
+		data.ValidateTOTPCode(v, input.Code)
+	}
+	app.validateOrganizationClaim(v, input.OrganizationID)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	user, err := app.models.UserModel.GetForToken(r.Context(), data.ScopeMFAPending, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddFieldError("mfa_token", "invalid or expired mfa token")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// 6位验证码很容易被穷举，同样按账户限制失败次数
+	attemptKey := mfaAttemptKey(user.ID)
+	if !app.checkLockout(w, r, attemptKey) {
+		return
+	}
+
+	if input.RecoveryCode != "" {
+		// 恢复码只能使用一次
+		err = app.models.TokenModel.Consume(r.Context(), data.ScopeMFARecovery, user.ID, input.RecoveryCode)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.failedLoginResponse(w, r, attemptKey)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	} else {
+		secret, err := app.models.TOTPModel.Get(r.Context(), user.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidCredentialsResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		ok, err := app.verifyTOTP(r.Context(), secret, input.Code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.failedLoginResponse(w, r, attemptKey)
+			return
+		}
+	}
+
+	err = app.clearFailedAttempts(r.Context(), attemptKey)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TokenModel.DeleteAllForUser(r.Context(), data.ScopeMFAPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	tokens, err := app.loginUser(r, user, input.OrganizationID)
+	if err != nil {
+		app.issueTokensErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusCreated, tokens, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/totp"
+)
+
+func totpCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+
+	code, err := totp.CodeAt(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTOTP(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+	user := ts.createUser(t, "Alice")
+
+	res := ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/users/me/totp", token: user.token}, http.StatusCreated)
+	secret := jsonString(t, res.body, "totp", "secret")
+
+	// 每个时间窗口的验证码只能使用一次，依次使用step和step+1，测试跨过窗口边界时仍然有效
+	step := totp.Step(time.Now())
+	ts.expect(t, testRequest{method: http.MethodPut, path: "/v1/users/me/totp", token: user.token, body: map[string]string{"code": "000000"}}, http.StatusUnprocessableEntity)
+	res = ts.expect(t, testRequest{method: http.MethodPut, path: "/v1/users/me/totp", token: user.token, body: map[string]string{"code": totpCode(t, secret, step)}}, http.StatusOK)
+	recoveryCodes := jsonValue(t, res.body, "recovery_codes").([]interface{})
+	if len(recoveryCodes) == 0 {
+		t.Fatal("no recovery codes returned")
+	}
+	ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/users/me/totp", token: user.token}, http.StatusUnprocessableEntity)
+
+	// 登录只拿到mfa token，用恢复码换取access token
+	login := testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/authentication",
+		body:   map[string]string{"email": user.email, "password": user.password},
+	}
+	res = ts.expect(t, login, http.StatusAccepted)
+	if _, ok := res.body["authentication_token"]; ok {
+		t.Fatal("access token issued before the second factor")
+	}
+	mfaToken := jsonString(t, res.body, "mfa_token", "token")
+
+	ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/mfa", body: map[string]string{"mfa_token": mfaToken, "code": totpCode(t, secret, step)}}, http.StatusUnauthorized)
+	res = ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/mfa", body: map[string]string{"mfa_token": mfaToken, "recovery_code": recoveryCodes[0].(string)}}, http.StatusCreated)
+	access := jsonString(t, res.body, "authentication_token")
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: access}, http.StatusOK)
+
+	// 恢复码只能使用一次
+	res = ts.expect(t, login, http.StatusAccepted)
+	mfaToken = jsonString(t, res.body, "mfa_token", "token")
+	ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/mfa", body: map[string]string{"mfa_token": mfaToken, "recovery_code": recoveryCodes[0].(string)}}, http.StatusUnauthorized)
+
+	// 关闭后登录直接签发access token
+	ts.expect(t, testRequest{method: http.MethodDelete, path: "/v1/users/me/totp", token: access, body: map[string]string{"code": totpCode(t, secret, step)}}, http.StatusUnprocessableEntity)
+	ts.expect(t, testRequest{method: http.MethodDelete, path: "/v1/users/me/totp", token: access, body: map[string]string{"code": totpCode(t, secret, step+1)}}, http.StatusOK)
+	ts.expect(t, login, http.StatusCreated)
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/pascaldekloe/jwt"
 	"github.com/tomasen/realip"
 
 	"github.com/embracexyz/greenlight/internal/data"
+	"github.com/embracexyz/greenlight/internal/validator"
 	"github.com/felixge/httpsnoop"
 	"golang.org/x/time/rate"
 )
@@ -30,6 +33,29 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// 为每个请求分配request id：沿用上游代理传入的X-Request-ID，否则随机生成；
+// 写入响应头、错误日志以及审计记录，方便串联排查
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 128 || !validator.Matches(requestID, requestIDRX) {
+			b := make([]byte, 16)
+			_, err := rand.Read(b)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			requestID = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+		r = app.setContextRequestID(r, requestID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
 func (app *application) rateLimit(next http.Handler) http.Handler {
 	// 这部分在初始化执行一次，所以limiter或者锁都是全局的
 	// 通过闭包方式被引用
@@ -43,23 +69,11 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	var (
 		mu      sync.Mutex
 		clients = make(map[string]*client)
+		// 下一次清理不活跃客户端的时间；在请求中顺带清理，不需要常驻的后台goroutine，
+		// 每次构建routes()也不会多出一个停不下来的goroutine
+		sweepAt = time.Now().Add(time.Minute)
 	)
 
-	if app.config.limiter.enabled {
-		go func() {
-			for {
-				time.Sleep(time.Minute)
-				mu.Lock()
-				for ip, client := range clients {
-					if time.Since(client.lastSeen) > time.Minute*3 {
-						delete(clients, ip)
-					}
-				}
-				mu.Unlock()
-			}
-		}()
-	}
-
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// 这里开始是每个reqeust过来，启动一个goroutine处理请求，从一个handler开始直到业务handler都在一个goroutine里（期间不启动其他goroutine的话）
 		//		中间件、业务handler、router，都是handler，都实现了ServeHTTP方法，都会被在多个goroutine执行
@@ -69,12 +83,22 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 
 			// 访问同一个map，加锁
 			mu.Lock()
+			now := time.Now()
+			if now.After(sweepAt) {
+				for ip, client := range clients {
+					if now.Sub(client.lastSeen) > time.Minute*3 {
+						delete(clients, ip)
+					}
+				}
+				sweepAt = now.Add(time.Minute)
+			}
+
 			if _, ok := clients[ip]; !ok {
 				// 新客户端添加一个limiter
 				clients[ip] = &client{limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
 			}
 
-			clients[ip].lastSeen = time.Now()
+			clients[ip].lastSeen = now
 			if !clients[ip].limiter.Allow() {
 				mu.Unlock()
 				app.rateLimmitExceededResponse(w, r)
@@ -105,40 +129,13 @@ func (app *application) authentication(next http.Handler) http.Handler {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
-		auth := headerParts[1]
-
-		// 从token获取userID信息
-		claims, err := jwt.HMACCheck([]byte(auth), []byte(app.config.jwt.secret))
-		if err != nil {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
-		}
-
-		if !claims.Valid(time.Now()) {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
-		}
-
-		if claims.Issuer != "greenlight.xyz" {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
-		}
-
-		if !claims.AcceptAudience("greenlight.xyz") {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
-		}
+		credential := headerParts[1]
 
-		userID, err := strconv.ParseInt(claims.Subject, 10, 64)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
-		}
-
-		user, err := app.models.UserModel.Get(userID)
+		// 按配置的认证链（jwt、不透明token、api key）认证
+		user, err := app.authenticate(r.Context(), credential)
 		if err != nil {
 			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
+			case errors.Is(err, ErrInvalidCredential), errors.Is(err, data.ErrRecordNotFound):
 				app.invalidAuthenticationTokenResponse(w, r)
 			default:
 				app.serverErrorResponse(w, r, err)
@@ -146,25 +143,6 @@ func (app *application) authentication(next http.Handler) http.Handler {
 			return
 		}
 
-		// v := validator.New()
-		// if data.ValidatorToken(v, auth); !v.Valid() {
-		// 	app.invalidAuthenticationTokenResponse(w, r)
-		// 	return
-		// }
-
-		// // 根据token查询用户
-
-		// user, err := app.models.UserModel.GetForToken(data.ScopeAuthentication, auth)
-		// if err != nil {
-		// 	switch {
-		// 	case errors.Is(err, data.ErrRecordNotFound):
-		// 		app.invalidAuthenticationTokenResponse(w, r)
-		// 	default:
-		// 		app.serverErrorResponse(w, r, err)
-		// 	}
-		// 	return
-		// }
-
 		r = app.setContextUser(r, user)
 		next.ServeHTTP(w, r)
 	})
@@ -199,18 +177,161 @@ func (app *application) authenticatedActivated(next http.HandlerFunc) http.Handl
 }
 
 // 先经过auth拿到user信息，后续经过需要登录用户，再经过需要激活用户、最后需要满足所需权限
+// 请求在某个组织范围内时，电影等组织内资源的权限只来自用户在该组织中的角色，全局权限只保留admin:*等与组织无关的部分；
+// 优先使用jwt中携带的权限（须与jwt指定的组织一致），否则查询（可能命中缓存）
+func (app *application) userPermissions(r *http.Request) (data.Permisions, error) {
+	user := app.getContextUser(r)
+	membership := app.getContextMembership(r)
+
+	var orgID int64
+	if membership != nil {
+		orgID = membership.OrganizationID
+	}
+	if user.Permissions != nil && user.OrganizationID == orgID {
+		return user.Permissions, nil
+	}
+
+	permissions, err := app.models.PermisionModel.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if membership != nil {
+		permissions = membership.ScopePermissions(permissions)
+	}
+	return permissions, nil
+}
+
+// 在handler内部对具体资源鉴权：拥有code本身，或者拥有code+":own"并且是资源的所有者
+func (app *application) authorizeOwned(r *http.Request, code string, ownerID int64) (bool, error) {
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		return false, err
+	}
+	if permissions.Include(code) {
+		return true, nil
+	}
+	user := app.getContextUser(r)
+	return ownerID != 0 && ownerID == user.ID && permissions.Include(code+":own"), nil
+}
+
+// 请求在当前组织范围内执行：组织依次取自X-Organization-ID header、jwt的org claim，
+// 都没有指定时，只属于一个组织的用户默认使用该组织；用户必须是组织的成员
+func (app *application) requireOrganization(next http.HandlerFunc) http.HandlerFunc {
+	return app.withOrganization(func(r *http.Request) (int64, error) {
+		if header := r.Header.Get("X-Organization-ID"); header != "" {
+			orgID, err := strconv.ParseInt(header, 10, 64)
+			if err != nil || orgID < 1 {
+				return 0, ErrInvalidOrganization
+			}
+			return orgID, nil
+		}
+
+		user := app.getContextUser(r)
+		if user.OrganizationID != 0 {
+			return user.OrganizationID, nil
+		}
+
+		orgs, err := app.models.OrganizationModel.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			return 0, err
+		}
+		if len(orgs) != 1 {
+			return 0, ErrOrganizationRequired
+		}
+		return orgs[0].ID, nil
+	}, next)
+}
+
+// 组织由url中的id指定，用于管理组织本身的接口
+func (app *application) requirePathOrganization(next http.HandlerFunc) http.HandlerFunc {
+	return app.withOrganization(func(r *http.Request) (int64, error) {
+		return app.readIDParam(r)
+	}, next)
+}
+
+func (app *application) withOrganization(resolve func(*http.Request) (int64, error), next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "X-Organization-ID")
+
+		orgID, err := resolve(r)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrInvalidId):
+				app.notFoundResponse(w, r)
+			case errors.Is(err, ErrInvalidOrganization), errors.Is(err, ErrOrganizationRequired):
+				app.badRequestErrorReponse(w, r, err)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// jwt携带了该组织内的权限时，签发时已确认是成员，不再查询成员关系；
+		// 与携带的权限一样，被移出组织要到access token过期时才生效。此时权限由userPermissions直接取自jwt
+		user := app.getContextUser(r)
+		membership := &data.Membership{OrganizationID: orgID, UserID: user.ID}
+		if user.Permissions == nil || user.OrganizationID != orgID {
+			membership, err = app.models.OrganizationModel.GetMembership(r.Context(), orgID, user.ID)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.notMemberResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+		}
+
+		r = app.setContextMembership(r, membership)
+		next.ServeHTTP(w, r)
+	})
+	return app.authenticatedRequired(fn)
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requireAllPermissions([]string{code}, next)
+}
+
+// 需要拥有codes中的任意一个权限
+func (app *application) requireAnyPermission(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	return app.checkPermissions(func(permissions data.Permisions) bool {
+		return permissions.IncludeAny(codes...)
+	}, next)
+}
+
+// 需要同时拥有codes中的所有权限
+func (app *application) requireAllPermissions(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	return app.checkPermissions(func(permissions data.Permisions) bool {
+		return permissions.IncludeAll(codes...)
+	}, next)
+}
+
+func (app *application) checkPermissions(allowed func(data.Permisions) bool, next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.getContextUser(r)
-		permissions, err := app.models.PermisionModel.GetAllForUser(user.ID)
+		permissions, err := app.userPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
-		if !permissions.Include(code) {
+		if !allowed(permissions) {
 			app.notPermittedResponse(w, r)
 			return
 		}
+
+		// 可选：拥有写权限的账户必须启用两步验证
+		if app.config.mfa.enforceWriters && permissions.IncludeAny("movies:write", "movies:write:own") {
+			enabled, err := app.mfaEnabled(r.Context(), user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			if !enabled {
+				app.mfaEnrollmentRequiredResponse(w, r)
+				return
+			}
+		}
 		next.ServeHTTP(w, r)
 	})
 	return app.authenticatedActivated(fn)
@@ -239,7 +360,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 					// 这里allow-methods没有post，因为post允许简单跨域请求
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Organization-ID")
 
 						w.WriteHeader(http.StatusOK)
 						return
@@ -251,13 +372,15 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) metrics(next http.Handler) http.Handler {
-	totalRequestsReceived := expvar.NewInt("total_requests_received")
-	totalResponsesSent := expvar.NewInt("total_responses_sent")
-	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
-
-	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
+// expvar的变量名全局唯一，定义在包级别，routes()可以被多次调用（例如每个测试构造一个application）
+var (
+	totalRequestsReceived           = expvar.NewInt("total_requests_received")
+	totalResponsesSent              = expvar.NewInt("total_responses_sent")
+	totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
+	totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
+)
 
+func (app *application) metrics(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		totalRequestsReceived.Add(1)
 
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/embracexyz/greenlight/internal/data"
+)
+
+func TestRateLimit(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t, func(cfg *config) {
+		cfg.limiter.enabled = true
+		cfg.limiter.rps = 0.01
+		cfg.limiter.burst = 2
+	}))
+
+	request := func(ip string) testRequest {
+		return testRequest{method: http.MethodGet, path: "/v1/healthcheck", header: http.Header{"X-Real-Ip": {ip}}}
+	}
+	ts.expect(t, request("203.0.113.5"), http.StatusOK)
+	ts.expect(t, request("203.0.113.5"), http.StatusOK)
+	res := ts.expect(t, request("203.0.113.5"), http.StatusTooManyRequests)
+	if res.body["error"] == nil {
+		t.Errorf("429 response without an error: %v", res.body)
+	}
+
+	// 每个客户端单独计数
+	ts.expect(t, request("203.0.113.6"), http.StatusOK)
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t, func(cfg *config) {
+		cfg.limiter.rps = 0.01
+		cfg.limiter.burst = 1
+	}))
+
+	for i := 0; i < 5; i++ {
+		ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/healthcheck"}, http.StatusOK)
+	}
+}
+
+// 每次构建routes()不应该留下常驻的goroutine
+func TestRoutesNoGoroutineLeak(t *testing.T) {
+	app := newTestApplication(t, func(cfg *config) {
+		cfg.limiter.enabled = true
+	})
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		app.routes()
+	}
+	if after := runtime.NumGoroutine(); after >= before+20 {
+		t.Errorf("goroutines grew from %d to %d after building routes 20 times", before, after)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+
+	tests := []struct {
+		name        string
+		method      string
+		header      http.Header
+		status      int
+		allowOrigin string
+		allowMethod string
+	}{
+		{
+			name:        "preflight from trusted origin",
+			method:      http.MethodOptions,
+			header:      http.Header{"Origin": {"https://trusted.example.com"}, "Access-Control-Request-Method": {http.MethodPut}},
+			status:      http.StatusOK,
+			allowOrigin: "https://trusted.example.com",
+			allowMethod: "OPTIONS, PUT, PATCH, DELETE",
+		},
+		{
+			name:   "preflight from untrusted origin",
+			method: http.MethodOptions,
+			header: http.Header{"Origin": {"https://evil.example.com"}, "Access-Control-Request-Method": {http.MethodPut}},
+			status: http.StatusOK,
+		},
+		{
+			name:        "simple request from trusted origin",
+			method:      http.MethodGet,
+			header:      http.Header{"Origin": {"https://trusted.example.com"}},
+			status:      http.StatusOK,
+			allowOrigin: "https://trusted.example.com",
+		},
+		{
+			name:   "simple request from untrusted origin",
+			method: http.MethodGet,
+			header: http.Header{"Origin": {"https://evil.example.com"}},
+			status: http.StatusOK,
+		},
+		{
+			name:   "no origin",
+			method: http.MethodGet,
+			status: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.expect(t, testRequest{method: tt.method, path: "/v1/healthcheck", header: tt.header}, tt.status)
+			if got := res.header.Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowOrigin)
+			}
+			if got := res.header.Get("Access-Control-Allow-Methods"); got != tt.allowMethod {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.allowMethod)
+			}
+			vary := res.header.Values("Vary")
+			if !slices.Contains(vary, "Origin") || !slices.Contains(vary, "Access-Control-Request-Method") {
+				t.Errorf("Vary = %q", vary)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"generated", "", false},
+		{"from proxy", "abc-123.def_456", true},
+		{"invalid characters", "abc 123\"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.header != "" {
+				header.Set("X-Request-ID", tt.header)
+			}
+			res := ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/healthcheck", header: header}, http.StatusOK)
+			got := res.header.Get("X-Request-ID")
+			if tt.keep && got != tt.header {
+				t.Errorf("X-Request-ID = %q, want %q", got, tt.header)
+			}
+			if !tt.keep && (got == "" || got == tt.header) {
+				t.Errorf("X-Request-ID = %q, want a generated id", got)
+			}
+		})
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	app := newTestApplication(t)
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})).ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if rr.Header().Get("Connection") != "close" {
+		t.Errorf("Connection = %q, want close", rr.Header().Get("Connection"))
+	}
+}
+
+// 开启-mfa-enforce-writers时，拥有写权限但没有启用两步验证的账户被拒绝，只读的账户不受影响
+func TestMFAEnforcement(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t, func(cfg *config) {
+		cfg.mfa.enforceWriters = true
+	}))
+	owner := ts.createUser(t, "Owner")
+	viewer := ts.createUser(t, "Viewer")
+	res := ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/organizations", token: owner.token, body: map[string]string{"name": "Studio"}}, http.StatusCreated)
+	orgID := jsonInt(t, res.body, "organization", "id")
+	studio := http.Header{"X-Organization-ID": {fmt.Sprint(orgID)}}
+
+	// owner拥有movies:write，管理组织同样被拒绝
+	ts.expect(t, testRequest{
+		method: http.MethodPut,
+		path:   fmt.Sprintf("/v1/organizations/%d/members/%d", orgID, viewer.id),
+		token:  owner.token,
+		body:   map[string]string{"role": "viewer"},
+	}, http.StatusForbidden)
+
+	res = ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/movies", token: owner.token, body: testMovie("Moana"), header: studio}, http.StatusForbidden)
+	if res.body["error"] != "your user account must enable two-factor authentication to access this resource" {
+		t.Errorf("error = %v", res.body["error"])
+	}
+
+	// 没有写权限的账户不要求两步验证
+	err := ts.app.models.OrganizationModel.SetMember(context.Background(), &data.Membership{OrganizationID: orgID, UserID: viewer.id, Role: "viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/movies/suggest?q=Mo", token: viewer.token, header: studio}, http.StatusOK)
+}
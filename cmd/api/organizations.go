@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/embracexyz/greenlight/internal/data"
+	"github.com/embracexyz/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+var ErrLastOwner = errors.New("organization must keep at least one owner")
+
+// 当前用户所属的组织，以及在各组织中的角色
+func (app *application) listOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	orgs, err := app.models.OrganizationModel.GetAllForUser(r.Context(), app.getContextUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"organizations": orgs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 任何激活用户都可以创建组织，创建者成为组织的owner
+func (app *application) createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	org := &data.Organization{Name: input.Name}
+	v := validator.New()
+	if data.ValidateOrganization(v, org); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.OrganizationModel.Insert(r.Context(), org, app.getContextUser(r).ID)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "organization.create", "organization", org.ID, nil, org))
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusCreated, envelope{"organization": org}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listMembersHandler(w http.ResponseWriter, r *http.Request) {
+	members, err := app.models.OrganizationModel.GetMembers(r.Context(), app.getContextOrganizationID(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"members": members}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 添加成员或修改成员的角色
+func (app *application) setMemberHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.readMemberParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Role string `json:"role"`
+	}
+	err = app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	membership := &data.Membership{
+		OrganizationID: app.getContextOrganizationID(r),
+		UserID:         userID,
+		Role:           input.Role,
+	}
+	v := validator.New()
+	if data.ValidateMembership(v, membership); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	// 检查剩余owner与修改成员需要在serializable事务中进行，避免两个owner同时降级对方
+	err = app.models.WithTxOptions(r.Context(), &sql.TxOptions{Isolation: sql.LevelSerializable}, func(m data.Models) error {
+		before, err := m.OrganizationModel.GetMembership(r.Context(), membership.OrganizationID, userID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			return err
+		}
+
+		if before != nil && before.Role == "owner" && membership.Role != "owner" {
+			err = app.checkRemainingOwners(r.Context(), m, membership.OrganizationID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = m.OrganizationModel.SetMember(r.Context(), membership)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "organization.member_set", "organization", membership.OrganizationID, before, membership))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, ErrLastOwner):
+			v.AddFieldError("role", "the organization must keep at least one owner")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"member": membership}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) removeMemberHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.readMemberParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	orgID := app.getContextOrganizationID(r)
+	err = app.models.WithTxOptions(r.Context(), &sql.TxOptions{Isolation: sql.LevelSerializable}, func(m data.Models) error {
+		before, err := m.OrganizationModel.GetMembership(r.Context(), orgID, userID)
+		if err != nil {
+			return err
+		}
+
+		if before.Role == "owner" {
+			err = app.checkRemainingOwners(r.Context(), m, orgID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = m.OrganizationModel.RemoveMember(r.Context(), orgID, userID)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "organization.member_remove", "organization", orgID, before, nil))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, ErrLastOwner):
+			app.errorResponse(w, r, http.StatusConflict, "the organization must keep at least one owner")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "member removed successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 降级或移除一个owner之前确认组织还有其他owner，否则组织将无人管理
+func (app *application) checkRemainingOwners(ctx context.Context, m data.Models, orgID int64) error {
+	members, err := m.OrganizationModel.GetMembers(ctx, orgID)
+	if err != nil {
+		return err
+	}
+
+	owners := 0
+	for _, member := range members {
+		if member.Role == "owner" {
+			owners++
+		}
+	}
+	if owners <= 1 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+func (app *application) readMemberParam(r *http.Request) (int64, error) {
+	param := httprouter.ParamsFromContext(r.Context()).ByName("user_id")
+
+	userID, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || userID < 1 {
+		return 0, ErrInvalidId
+	}
+	return userID, nil
+}
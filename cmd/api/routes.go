@@ -16,27 +16,77 @@ func (app *application) routes() http.Handler {
 	// 匿名用户即可
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
-	// 所有登录账户即可访问
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.authenticatedRequired(app.listMoviesHandler))
+	// 电影属于组织，以下接口都在当前组织范围内执行，权限按组织计算
+	// 组织内的所有登录账户即可访问
+	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requireOrganization(app.listMoviesHandler))
 
 	// 登录且激活账户、且需要满足相应权限的用户
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPut, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.partialUpdateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requireOrganization(app.requireAnyPermission([]string{"movies:write", "movies:write:own"}, app.createMovieHandler)))
+	// 同时处理GET /v1/movies/suggest（标题自动补全）
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requireOrganization(app.requirePermission("movies:read", app.movieOrSuggestHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id", app.requireOrganization(app.requireAnyPermission([]string{"movies:write", "movies:write:own"}, app.updateMovieHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requireOrganization(app.requireAnyPermission([]string{"movies:write", "movies:write:own"}, app.partialUpdateMovieHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requireOrganization(app.requireAnyPermission([]string{"movies:write", "movies:write:own"}, app.deleteMovieHandler)))
+
+	// organizations
+	router.HandlerFunc(http.MethodGet, "/v1/organizations", app.authenticatedActivated(app.listOrganizationsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/organizations", app.authenticatedActivated(app.createOrganizationHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/organizations/:id/members", app.requirePathOrganization(app.authenticatedActivated(app.listMembersHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/organizations/:id/members/:user_id", app.requirePathOrganization(app.requirePermission("organizations:write", app.setMemberHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/organizations/:id/members/:user_id", app.requirePathOrganization(app.requirePermission("organizations:write", app.removeMemberHandler)))
 
 	// users
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.authenticatedRequired(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.authenticatedActivated(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.authenticatedRequired(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.authenticatedRequired(app.exportCurrentUserHandler))
+
+	// two-factor authentication
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.authenticatedActivated(app.createTOTPHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp", app.authenticatedActivated(app.confirmTOTPHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.authenticatedActivated(app.deleteTOTPHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activated", app.createActivationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.authenticatedRequired(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFAAuthenticationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+
+	router.HandlerFunc(http.MethodGet, "/.well-known/jwks.json", app.jwksHandler)
+
+	// api keys
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.authenticatedActivated(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.authenticatedActivated(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.authenticatedActivated(app.deleteAPIKeyHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requireAnyPermission([]string{"admin:read", "admin:write"}, app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requireAnyPermission([]string{"admin:read", "admin:write"}, app.showUserAccessHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("admin:write", app.addUserRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission("admin:write", app.removeUserRoleHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("admin:write", app.addUserPermissionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("admin:write", app.removeUserPermissionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requireAnyPermission([]string{"admin:read", "admin:write"}, app.listRolesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requireAnyPermission([]string{"admin:read", "admin:write"}, app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/permissions", app.requirePermission("admin:write", app.createPermissionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit", app.requireAnyPermission([]string{"admin:read", "admin:write"}, app.listAuditEntriesHandler))
 
 	// metric
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authentication(router)))))
+	return app.metrics(app.requestID(app.recoverPanic(app.enableCORS(app.rateLimit(app.authentication(router))))))
+}
+
+// httprouter不允许静态路径与参数出现在同一级，/v1/movies/suggest由/v1/movies/:id分发
+func (app *application) movieOrSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	if httprouter.ParamsFromContext(r.Context()).ByName("id") == "suggest" {
+		app.suggestMoviesHandler(w, r)
+		return
+	}
+	app.showMovieHandler(w, r)
 }
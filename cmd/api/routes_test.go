@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// 路由测试共用的数据：owner创建了组织和两部电影，viewer是组织的viewer，
+// outsider只属于自己的个人组织，admin拥有admin角色，inactive注册后没有激活；
+// owner和viewer同时属于个人组织和该组织，登录时指定了该组织
+type routeFixture struct {
+	owner, viewer, outsider, admin, inactive testUser
+
+	orgID int64
+	// movieID用于查询和修改，otherMovieID用于删除
+	movieID, otherMovieID int64
+}
+
+func newRouteFixture(t *testing.T, ts *testServer) routeFixture {
+	t.Helper()
+
+	var f routeFixture
+	f.owner = ts.createUser(t, "Owner")
+	f.viewer = ts.createUser(t, "Viewer")
+	f.outsider = ts.createUser(t, "Outsider")
+	f.admin = ts.createUser(t, "Admin")
+	ts.addRole(t, f.admin, "admin")
+	f.inactive = ts.registerUser(t, "Inactive")
+
+	res := ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/organizations",
+		token:  f.owner.token,
+		body:   map[string]string{"name": "Studio"},
+	}, http.StatusCreated)
+	f.orgID = jsonInt(t, res.body, "organization", "id")
+
+	ts.expect(t, testRequest{
+		method: http.MethodPut,
+		path:   fmt.Sprintf("/v1/organizations/%d/members/%d", f.orgID, f.viewer.id),
+		token:  f.owner.token,
+		body:   map[string]string{"role": "viewer"},
+	}, http.StatusOK)
+	f.owner.token = ts.authenticateIn(t, f.owner, f.orgID)
+	f.viewer.token = ts.authenticateIn(t, f.viewer, f.orgID)
+
+	f.movieID = ts.createMovie(t, f.owner, "Moana")
+	f.otherMovieID = ts.createMovie(t, f.owner, "Heat")
+	return f
+}
+
+func (ts *testServer) createMovie(t *testing.T, user testUser, title string) int64 {
+	t.Helper()
+
+	res := ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/movies",
+		token:  user.token,
+		body:   testMovie(title),
+	}, http.StatusCreated)
+	return jsonInt(t, res.body, "movie", "id")
+}
+
+func testMovie(title string) map[string]interface{} {
+	return map[string]interface{}{
+		"title":   title,
+		"year":    2016,
+		"runtime": "107 mins",
+		"genres":  []string{"animation", "adventure"},
+	}
+}
+
+// routes.go中的每个路由至少有一个用例；用例按顺序执行，后面的用例可能依赖前面用例的结果
+func TestRoutes(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+	f := newRouteFixture(t, ts)
+
+	otherOrg := http.Header{"X-Organization-ID": {fmt.Sprint(f.orgID + 100)}}
+	ownOrg := http.Header{"X-Organization-ID": {fmt.Sprint(f.orgID)}}
+	invalidToken := "AAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+	tests := []struct {
+		name   string
+		req    testRequest
+		status int
+	}{
+		{"healthcheck", testRequest{method: http.MethodGet, path: "/v1/healthcheck"}, http.StatusOK},
+		{"unknown route", testRequest{method: http.MethodGet, path: "/v1/unknown"}, http.StatusNotFound},
+		{"method not allowed", testRequest{method: http.MethodPost, path: "/v1/healthcheck"}, http.StatusMethodNotAllowed},
+		{"invalid authorization header", testRequest{method: http.MethodGet, path: "/v1/healthcheck", header: http.Header{"Authorization": {"Basic abc"}}}, http.StatusUnauthorized},
+		{"invalid jwt", testRequest{method: http.MethodGet, path: "/v1/users/me", token: "a.b.c"}, http.StatusUnauthorized},
+
+		// movies
+		{"list movies anonymous", testRequest{method: http.MethodGet, path: "/v1/movies"}, http.StatusUnauthorized},
+		{"list movies without organization", testRequest{method: http.MethodGet, path: "/v1/movies", token: ts.authenticate(t, f.owner.email, f.owner.password)}, http.StatusBadRequest},
+		{"list movies in personal organization", testRequest{method: http.MethodGet, path: "/v1/movies", token: f.outsider.token}, http.StatusOK},
+		{"list movies invalid organization header", testRequest{method: http.MethodGet, path: "/v1/movies", token: f.viewer.token, header: http.Header{"X-Organization-ID": {"abc"}}}, http.StatusBadRequest},
+		{"list movies not a member", testRequest{method: http.MethodGet, path: "/v1/movies", token: f.viewer.token, header: otherOrg}, http.StatusForbidden},
+		{"list movies", testRequest{method: http.MethodGet, path: "/v1/movies?genres=animation&sort=-year", token: f.viewer.token}, http.StatusOK},
+		{"list movies with organization header", testRequest{method: http.MethodGet, path: "/v1/movies", token: f.owner.token, header: ownOrg}, http.StatusOK},
+		{"list movies invalid filters", testRequest{method: http.MethodGet, path: "/v1/movies?page=0&sort=plot", token: f.viewer.token}, http.StatusUnprocessableEntity},
+		{"create movie without permission", testRequest{method: http.MethodPost, path: "/v1/movies", token: f.viewer.token, body: testMovie("Up")}, http.StatusForbidden},
+		{"create movie outside organization", testRequest{method: http.MethodPost, path: "/v1/movies", token: f.outsider.token, body: testMovie("Up"), header: ownOrg}, http.StatusForbidden},
+		{"create movie invalid", testRequest{method: http.MethodPost, path: "/v1/movies", token: f.owner.token, body: map[string]interface{}{"title": "", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}}, http.StatusUnprocessableEntity},
+		{"create movie invalid runtime", testRequest{method: http.MethodPost, path: "/v1/movies", token: f.owner.token, body: `{"title": "Up", "year": 2009, "runtime": 96, "genres": ["animation"]}`}, http.StatusBadRequest},
+		{"create movie", testRequest{method: http.MethodPost, path: "/v1/movies", token: f.owner.token, body: testMovie("Up")}, http.StatusCreated},
+		{"show movie", testRequest{method: http.MethodGet, path: fmt.Sprintf("/v1/movies/%d", f.movieID), token: f.viewer.token}, http.StatusOK},
+		{"show movie not a member", testRequest{method: http.MethodGet, path: fmt.Sprintf("/v1/movies/%d", f.movieID), token: f.outsider.token, header: ownOrg}, http.StatusForbidden},
+		{"show movie missing", testRequest{method: http.MethodGet, path: "/v1/movies/999", token: f.viewer.token}, http.StatusNotFound},
+		{"show movie invalid id", testRequest{method: http.MethodGet, path: "/v1/movies/abc", token: f.viewer.token}, http.StatusNotFound},
+		{"suggest movies", testRequest{method: http.MethodGet, path: "/v1/movies/suggest?q=Mo", token: f.viewer.token}, http.StatusOK},
+		{"suggest movies without query", testRequest{method: http.MethodGet, path: "/v1/movies/suggest", token: f.viewer.token}, http.StatusUnprocessableEntity},
+		{"update movie without permission", testRequest{method: http.MethodPut, path: fmt.Sprintf("/v1/movies/%d", f.movieID), token: f.viewer.token, body: testMovie("Moana")}, http.StatusForbidden},
+		{"update movie", testRequest{method: http.MethodPut, path: fmt.Sprintf("/v1/movies/%d", f.movieID), token: f.owner.token, body: testMovie("Moana")}, http.StatusOK},
+		{"update movie missing", testRequest{method: http.MethodPut, path: "/v1/movies/999", token: f.owner.token, body: testMovie("Moana")}, http.StatusNotFound},
+		{"partial update movie", testRequest{method: http.MethodPatch, path: fmt.Sprintf("/v1/movies/%d", f.movieID), token: f.owner.token, body: map[string]string{"title": "Moana 2"}}, http.StatusOK},
+		{"partial update movie malformed json", testRequest{method: http.MethodPatch, path: fmt.Sprintf("/v1/movies/%d", f.movieID), token: f.owner.token, body: `{"title": `}, http.StatusBadRequest},
+		{"partial update movie unknown field", testRequest{method: http.MethodPatch, path: fmt.Sprintf("/v1/movies/%d", f.movieID), token: f.owner.token, body: map[string]string{"rating": "PG"}}, http.StatusBadRequest},
+		{"partial update movie invalid", testRequest{method: http.MethodPatch, path: fmt.Sprintf("/v1/movies/%d", f.movieID), token: f.owner.token, body: map[string]int{"year": 1800}}, http.StatusUnprocessableEntity},
+		{"delete movie without permission", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/movies/%d", f.otherMovieID), token: f.viewer.token}, http.StatusForbidden},
+		{"delete movie", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/movies/%d", f.otherMovieID), token: f.owner.token}, http.StatusOK},
+		{"delete movie again", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/movies/%d", f.otherMovieID), token: f.owner.token}, http.StatusNotFound},
+
+		// organizations
+		{"list organizations anonymous", testRequest{method: http.MethodGet, path: "/v1/organizations"}, http.StatusUnauthorized},
+		{"list organizations inactive", testRequest{method: http.MethodGet, path: "/v1/organizations", token: f.inactive.token}, http.StatusForbidden},
+		{"list organizations", testRequest{method: http.MethodGet, path: "/v1/organizations", token: f.owner.token}, http.StatusOK},
+		{"create organization invalid", testRequest{method: http.MethodPost, path: "/v1/organizations", token: f.admin.token, body: map[string]string{"name": ""}}, http.StatusUnprocessableEntity},
+		{"create organization inactive", testRequest{method: http.MethodPost, path: "/v1/organizations", token: f.inactive.token, body: map[string]string{"name": "Garage"}}, http.StatusForbidden},
+		{"create organization", testRequest{method: http.MethodPost, path: "/v1/organizations", token: f.admin.token, body: map[string]string{"name": "Garage"}}, http.StatusCreated},
+		{"list members", testRequest{method: http.MethodGet, path: fmt.Sprintf("/v1/organizations/%d/members", f.orgID), token: f.viewer.token}, http.StatusOK},
+		{"list members not a member", testRequest{method: http.MethodGet, path: fmt.Sprintf("/v1/organizations/%d/members", f.orgID), token: f.outsider.token}, http.StatusForbidden},
+		{"list members invalid id", testRequest{method: http.MethodGet, path: "/v1/organizations/abc/members", token: f.owner.token}, http.StatusNotFound},
+		{"set member without permission", testRequest{method: http.MethodPut, path: fmt.Sprintf("/v1/organizations/%d/members/%d", f.orgID, f.admin.id), token: f.viewer.token, body: map[string]string{"role": "editor"}}, http.StatusForbidden},
+		{"set member invalid role", testRequest{method: http.MethodPut, path: fmt.Sprintf("/v1/organizations/%d/members/%d", f.orgID, f.admin.id), token: f.owner.token, body: map[string]string{"role": "janitor"}}, http.StatusUnprocessableEntity},
+		{"set member", testRequest{method: http.MethodPut, path: fmt.Sprintf("/v1/organizations/%d/members/%d", f.orgID, f.admin.id), token: f.owner.token, body: map[string]string{"role": "editor"}}, http.StatusOK},
+		{"remove member without permission", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/organizations/%d/members/%d", f.orgID, f.admin.id), token: f.viewer.token}, http.StatusForbidden},
+		{"remove member", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/organizations/%d/members/%d", f.orgID, f.admin.id), token: f.owner.token}, http.StatusOK},
+		{"remove member missing", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/organizations/%d/members/%d", f.orgID, f.admin.id), token: f.owner.token}, http.StatusNotFound},
+		{"remove last owner", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/organizations/%d/members/%d", f.orgID, f.owner.id), token: f.owner.token}, http.StatusConflict},
+
+		// users
+		{"register user malformed json", testRequest{method: http.MethodPost, path: "/v1/users", body: `{"name": "New"`}, http.StatusBadRequest},
+		{"register user invalid", testRequest{method: http.MethodPost, path: "/v1/users", body: map[string]string{"name": "New", "email": "not-an-email", "password": "short"}}, http.StatusUnprocessableEntity},
+		{"register user duplicate email", testRequest{method: http.MethodPost, path: "/v1/users", body: map[string]string{"name": "New", "email": f.owner.email, "password": "pa55word1234"}}, http.StatusUnprocessableEntity},
+		{"register user", testRequest{method: http.MethodPost, path: "/v1/users", body: map[string]string{"name": "New", "email": "new@example.com", "password": "pa55word1234"}}, http.StatusCreated},
+		{"activate user invalid token", testRequest{method: http.MethodPut, path: "/v1/users/activated", body: map[string]string{"token": invalidToken}}, http.StatusUnprocessableEntity},
+		{"reset password invalid token", testRequest{method: http.MethodPut, path: "/v1/users/password", body: map[string]string{"password": "newpa55word1234", "token": invalidToken}}, http.StatusUnprocessableEntity},
+		{"confirm email invalid token", testRequest{method: http.MethodPut, path: "/v1/users/email", body: map[string]string{"token": invalidToken}}, http.StatusUnprocessableEntity},
+		{"show current user anonymous", testRequest{method: http.MethodGet, path: "/v1/users/me"}, http.StatusUnauthorized},
+		{"show current user inactive", testRequest{method: http.MethodGet, path: "/v1/users/me", token: f.inactive.token}, http.StatusOK},
+		{"show current user", testRequest{method: http.MethodGet, path: "/v1/users/me", token: f.owner.token}, http.StatusOK},
+		{"update current user inactive", testRequest{method: http.MethodPatch, path: "/v1/users/me", token: f.inactive.token, body: map[string]string{"name": "Active"}}, http.StatusForbidden},
+		{"update current user invalid", testRequest{method: http.MethodPatch, path: "/v1/users/me", token: f.owner.token, body: map[string]string{"name": ""}}, http.StatusUnprocessableEntity},
+		{"update current user", testRequest{method: http.MethodPatch, path: "/v1/users/me", token: f.owner.token, body: map[string]string{"name": "Owner Renamed"}}, http.StatusOK},
+		{"delete current user wrong password", testRequest{method: http.MethodDelete, path: "/v1/users/me", token: f.owner.token, body: map[string]string{"password": "wrongpa55word"}}, http.StatusUnauthorized},
+		{"export current user anonymous", testRequest{method: http.MethodGet, path: "/v1/users/me/export"}, http.StatusUnauthorized},
+		{"export current user", testRequest{method: http.MethodGet, path: "/v1/users/me/export", token: f.owner.token}, http.StatusOK},
+
+		// two-factor authentication
+		{"enroll totp inactive", testRequest{method: http.MethodPost, path: "/v1/users/me/totp", token: f.inactive.token}, http.StatusForbidden},
+		{"confirm totp not enrolled", testRequest{method: http.MethodPut, path: "/v1/users/me/totp", token: f.owner.token, body: map[string]string{"code": "123456"}}, http.StatusUnprocessableEntity},
+		{"disable totp not enrolled", testRequest{method: http.MethodDelete, path: "/v1/users/me/totp", token: f.owner.token, body: map[string]string{"code": "123456"}}, http.StatusNotFound},
+
+		// tokens
+		{"request activation token", testRequest{method: http.MethodPost, path: "/v1/tokens/activated", body: map[string]string{"email": f.inactive.email}}, http.StatusAccepted},
+		{"request activation token invalid email", testRequest{method: http.MethodPost, path: "/v1/tokens/activated", body: map[string]string{"email": "nope"}}, http.StatusUnprocessableEntity},
+		{"authenticate unknown user", testRequest{method: http.MethodPost, path: "/v1/tokens/authentication", body: map[string]string{"email": "nobody@example.com", "password": "pa55word1234"}}, http.StatusUnauthorized},
+		{"authenticate not a member", testRequest{method: http.MethodPost, path: "/v1/tokens/authentication", body: map[string]interface{}{"email": f.outsider.email, "password": f.outsider.password, "organization_id": f.orgID}}, http.StatusUnprocessableEntity},
+		{"authenticate", testRequest{method: http.MethodPost, path: "/v1/tokens/authentication", body: map[string]interface{}{"email": f.viewer.email, "password": f.viewer.password, "organization_id": f.orgID}}, http.StatusCreated},
+		{"logout anonymous", testRequest{method: http.MethodDelete, path: "/v1/tokens/authentication"}, http.StatusUnauthorized},
+		{"refresh invalid token", testRequest{method: http.MethodPost, path: "/v1/tokens/refresh", body: map[string]string{"token": invalidToken}}, http.StatusUnauthorized},
+		{"mfa invalid token", testRequest{method: http.MethodPost, path: "/v1/tokens/mfa", body: map[string]string{"mfa_token": invalidToken, "code": "123456"}}, http.StatusUnprocessableEntity},
+		{"request password reset", testRequest{method: http.MethodPost, path: "/v1/tokens/password-reset", body: map[string]string{"email": f.outsider.email}}, http.StatusAccepted},
+		{"request magic link", testRequest{method: http.MethodPost, path: "/v1/tokens/magic-link", body: map[string]string{"email": f.outsider.email}}, http.StatusAccepted},
+		{"jwks", testRequest{method: http.MethodGet, path: "/.well-known/jwks.json"}, http.StatusOK},
+
+		// api keys
+		{"list api keys inactive", testRequest{method: http.MethodGet, path: "/v1/api-keys", token: f.inactive.token}, http.StatusForbidden},
+		{"list api keys", testRequest{method: http.MethodGet, path: "/v1/api-keys", token: f.owner.token}, http.StatusOK},
+		{"create api key invalid", testRequest{method: http.MethodPost, path: "/v1/api-keys", token: f.owner.token, body: map[string]string{"name": ""}}, http.StatusUnprocessableEntity},
+		{"create api key", testRequest{method: http.MethodPost, path: "/v1/api-keys", token: f.owner.token, body: map[string]string{"name": "ci"}}, http.StatusCreated},
+		{"delete api key missing", testRequest{method: http.MethodDelete, path: "/v1/api-keys/999", token: f.owner.token}, http.StatusNotFound},
+
+		// admin
+		{"list users anonymous", testRequest{method: http.MethodGet, path: "/v1/admin/users"}, http.StatusUnauthorized},
+		{"list users without permission", testRequest{method: http.MethodGet, path: "/v1/admin/users", token: f.owner.token}, http.StatusForbidden},
+		{"list users", testRequest{method: http.MethodGet, path: "/v1/admin/users?sort=-id", token: f.admin.token}, http.StatusOK},
+		{"show user access", testRequest{method: http.MethodGet, path: fmt.Sprintf("/v1/admin/users/%d", f.outsider.id), token: f.admin.token}, http.StatusOK},
+		{"show user access missing", testRequest{method: http.MethodGet, path: "/v1/admin/users/999", token: f.admin.token}, http.StatusNotFound},
+		{"add role without permission", testRequest{method: http.MethodPost, path: fmt.Sprintf("/v1/admin/users/%d/roles", f.outsider.id), token: f.owner.token, body: map[string]string{"role": "editor"}}, http.StatusForbidden},
+		{"add unknown role", testRequest{method: http.MethodPost, path: fmt.Sprintf("/v1/admin/users/%d/roles", f.outsider.id), token: f.admin.token, body: map[string]string{"role": "janitor"}}, http.StatusUnprocessableEntity},
+		{"add organization role", testRequest{method: http.MethodPost, path: fmt.Sprintf("/v1/admin/users/%d/roles", f.outsider.id), token: f.admin.token, body: map[string]string{"role": "editor"}}, http.StatusUnprocessableEntity},
+		{"add role", testRequest{method: http.MethodPost, path: fmt.Sprintf("/v1/admin/users/%d/roles", f.outsider.id), token: f.admin.token, body: map[string]string{"role": "admin"}}, http.StatusOK},
+		{"remove role", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/admin/users/%d/roles/admin", f.outsider.id), token: f.admin.token}, http.StatusOK},
+		{"remove role again", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/admin/users/%d/roles/admin", f.outsider.id), token: f.admin.token}, http.StatusNotFound},
+		{"add unknown permission", testRequest{method: http.MethodPost, path: fmt.Sprintf("/v1/admin/users/%d/permissions", f.outsider.id), token: f.admin.token, body: map[string]string{"code": "admin:unknown"}}, http.StatusUnprocessableEntity},
+		{"add organization permission", testRequest{method: http.MethodPost, path: fmt.Sprintf("/v1/admin/users/%d/permissions", f.outsider.id), token: f.admin.token, body: map[string]string{"code": "movies:write"}}, http.StatusUnprocessableEntity},
+		{"add permission", testRequest{method: http.MethodPost, path: fmt.Sprintf("/v1/admin/users/%d/permissions", f.outsider.id), token: f.admin.token, body: map[string]string{"code": "admin:read"}}, http.StatusOK},
+		{"remove permission", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/admin/users/%d/permissions/admin:read", f.outsider.id), token: f.admin.token}, http.StatusOK},
+		{"remove permission again", testRequest{method: http.MethodDelete, path: fmt.Sprintf("/v1/admin/users/%d/permissions/admin:read", f.outsider.id), token: f.admin.token}, http.StatusNotFound},
+		{"list roles", testRequest{method: http.MethodGet, path: "/v1/admin/roles", token: f.admin.token}, http.StatusOK},
+		{"list permissions", testRequest{method: http.MethodGet, path: "/v1/admin/permissions", token: f.admin.token}, http.StatusOK},
+		{"create permission without permission", testRequest{method: http.MethodPost, path: "/v1/admin/permissions", token: f.owner.token, body: map[string]string{"code": "reports:read"}}, http.StatusForbidden},
+		{"create permission invalid", testRequest{method: http.MethodPost, path: "/v1/admin/permissions", token: f.admin.token, body: map[string]string{"code": "Reports Read"}}, http.StatusUnprocessableEntity},
+		{"create permission", testRequest{method: http.MethodPost, path: "/v1/admin/permissions", token: f.admin.token, body: map[string]string{"code": "reports:read"}}, http.StatusCreated},
+		{"create permission duplicate", testRequest{method: http.MethodPost, path: "/v1/admin/permissions", token: f.admin.token, body: map[string]string{"code": "reports:read"}}, http.StatusUnprocessableEntity},
+		{"list audit entries without permission", testRequest{method: http.MethodGet, path: "/v1/admin/audit", token: f.viewer.token}, http.StatusForbidden},
+		{"list audit entries", testRequest{method: http.MethodGet, path: "/v1/admin/audit", token: f.admin.token}, http.StatusOK},
+
+		{"metrics", testRequest{method: http.MethodGet, path: "/debug/vars"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, tt.req)
+			if res.status != tt.status {
+				t.Errorf("status = %d, want %d; body %v", res.status, tt.status, res.body)
+			}
+			if res.status >= http.StatusBadRequest && res.body["error"] == nil {
+				t.Errorf("error response without an error field: %v", res.body)
+			}
+		})
+	}
+}
+
+// 游标只能在签发时的过滤条件下使用；游标分页默认不返回总数
+func TestListMoviesCursor(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+	owner := ts.createUser(t, "Owner")
+	ts.createMovie(t, owner, "Moana")
+	ts.createMovie(t, owner, "Heat")
+
+	res := ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/movies?page_size=1", token: owner.token}, http.StatusOK)
+	after := url.QueryEscape(jsonString(t, res.body, "metadata", "next_cursor"))
+
+	res = ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/movies?page_size=1&after=" + after, token: owner.token}, http.StatusOK)
+	if total, ok := jsonValue(t, res.body, "metadata").(map[string]interface{})["total_records"]; ok {
+		t.Errorf("total_records = %v, want no count by default", total)
+	}
+	res = ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/movies?page_size=1&count=true&after=" + after, token: owner.token}, http.StatusOK)
+	if total := jsonInt(t, res.body, "metadata", "total_records"); total != 2 {
+		t.Errorf("total_records = %d, want 2", total)
+	}
+
+	res = ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/movies?page_size=1&title=Heat&after=" + after, token: owner.token}, http.StatusUnprocessableEntity)
+	if jsonString(t, res.body, "error", "after") != "was issued for different filters" {
+		t.Errorf("error = %v", res.body["error"])
+	}
+}
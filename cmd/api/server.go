@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,7 +14,14 @@ import (
 )
 
 func (app *application) serve() error {
+	// 所有请求的context都派生自baseCtx，优雅退出超时后取消，仍在执行的查询随之中断
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
 	srv := http.Server{
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 		Addr:         fmt.Sprintf(":%d", app.config.port),
 		Handler:      app.routes(),
 		ErrorLog:     log.New(app.logger, "", 0), // 实现io.Writer接口，借助标准log库包装为log.Logger，从而可以被http.Server使用
@@ -36,7 +44,9 @@ func (app *application) serve() error {
 		// 开始优雅退出
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		shutdownErr <- srv.Shutdown(ctx)
+		err := srv.Shutdown(ctx)
+		cancelRequests()
+		shutdownErr <- err
 
 		// wait background tasks
 		app.logger.PrintInfo("completing background tasks", map[string]string{
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/data"
+	"github.com/embracexyz/greenlight/internal/jsonlog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	// 测试中大量注册和登录，使用最低的哈希成本
+	err := data.SetPasswordParams(data.PasswordParams{Algorithm: data.PasswordAlgorithmBcrypt, BcryptCost: bcrypt.MinCost})
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// 记录发送的邮件，代替真实的smtp mailer
+type testMailer struct {
+	mu       sync.Mutex
+	messages []testMail
+}
+
+type testMail struct {
+	recipient string
+	template  string
+	data      map[string]interface{}
+}
+
+func (m *testMailer) Send(recipient, templateFile string, data interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values, _ := data.(map[string]interface{})
+	m.messages = append(m.messages, testMail{recipient: recipient, template: templateFile, data: values})
+	return nil
+}
+
+func (m *testMailer) last(recipient, templateFile string) (testMail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].recipient == recipient && m.messages[i].template == templateFile {
+			return m.messages[i], true
+		}
+	}
+	return testMail{}, false
+}
+
+// 使用内存存储和testMailer构造application，configure可以在构造之前修改配置
+func newTestApplication(t *testing.T, configure ...func(*config)) *application {
+	t.Helper()
+
+	var cfg config
+	cfg.env = "testing"
+	cfg.storage = "memory"
+	cfg.limiter.rps = 2
+	cfg.limiter.burst = 4
+	cfg.limiter.enabled = false
+	cfg.cors.trustedOrigins = []string{"https://trusted.example.com"}
+	cfg.jwt.secret = "test-secret"
+	cfg.jwt.accessTTL = 15 * time.Minute
+	cfg.jwt.refreshTTL = time.Hour
+	cfg.auth.methods = []string{"jwt", "apikey"}
+	cfg.lockout.enabled = true
+	cfg.lockout.policy = data.LockoutPolicy{
+		DelayAfter:  3,
+		BaseDelay:   time.Second,
+		MaxFailures: 10,
+		Duration:    15 * time.Minute,
+		Window:      15 * time.Minute,
+	}
+	cfg.sendLimit = data.SendLimit{Window: time.Hour, Max: 5}
+	for _, fn := range configure {
+		fn(&cfg)
+	}
+
+	app, err := newApplication(cfg, jsonlog.New(io.Discard, jsonlog.INFO), data.NewMemoryModels(), &testMailer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+type testServer struct {
+	*httptest.Server
+	app    *application
+	mailer *testMailer
+}
+
+func newTestServer(t *testing.T, app *application) *testServer {
+	t.Helper()
+
+	ts := httptest.NewServer(app.routes())
+	t.Cleanup(ts.Close)
+	return &testServer{Server: ts, app: app, mailer: app.mailer.(*testMailer)}
+}
+
+type testRequest struct {
+	method string
+	path   string
+	// Authorization: Bearer <token>，为空时匿名访问
+	token string
+	// 不是string时编码为json
+	body   interface{}
+	header http.Header
+}
+
+type testResponse struct {
+	status int
+	header http.Header
+	body   map[string]interface{}
+}
+
+func (ts *testServer) do(t *testing.T, req testRequest) testResponse {
+	t.Helper()
+
+	var body io.Reader
+	switch b := req.body.(type) {
+	case nil:
+	case string:
+		body = strings.NewReader(b)
+	default:
+		js, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(js)
+	}
+
+	r, err := http.NewRequest(req.method, ts.URL+req.path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range req.header {
+		r.Header[key] = values
+	}
+	if req.token != "" {
+		r.Header.Set("Authorization", "Bearer "+req.token)
+	}
+
+	rs, err := ts.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	content, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := testResponse{status: rs.StatusCode, header: rs.Header}
+	if len(bytes.TrimSpace(content)) != 0 {
+		if err := json.Unmarshal(content, &res.body); err != nil {
+			t.Fatalf("%s %s: decode response %q: %v", req.method, req.path, content, err)
+		}
+	}
+	return res
+}
+
+// 请求并确认响应状态码
+func (ts *testServer) expect(t *testing.T, req testRequest, status int) testResponse {
+	t.Helper()
+
+	res := ts.do(t, req)
+	if res.status != status {
+		t.Fatalf("%s %s: status = %d, want %d; body %v", req.method, req.path, res.status, status, res.body)
+	}
+	return res
+}
+
+// 等待后台发送完成，返回最近一封发给recipient的templateFile邮件中key的值
+func (ts *testServer) mailValue(t *testing.T, recipient, templateFile, key string) string {
+	t.Helper()
+
+	ts.app.wg.Wait()
+	mail, ok := ts.mailer.last(recipient, templateFile)
+	if !ok {
+		t.Fatalf("no %s sent to %s", templateFile, recipient)
+	}
+	value, ok := mail.data[key].(string)
+	if !ok {
+		t.Fatalf("%s sent to %s has no %s", templateFile, recipient, key)
+	}
+	return value
+}
+
+type testUser struct {
+	id       int64
+	name     string
+	email    string
+	password string
+	// access token
+	token string
+}
+
+func newTestUserInput(name string) testUser {
+	return testUser{
+		name:     name,
+		email:    strings.ToLower(strings.ReplaceAll(name, " ", ".")) + "@example.com",
+		password: "pa55word1234",
+	}
+}
+
+// 注册但不激活，返回的用户已登录
+func (ts *testServer) registerUser(t *testing.T, name string) testUser {
+	t.Helper()
+
+	user := newTestUserInput(name)
+	res := ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/users",
+		body:   map[string]string{"name": user.name, "email": user.email, "password": user.password},
+	}, http.StatusCreated)
+	user.id = jsonInt(t, res.body, "user", "id")
+	user.token = ts.authenticate(t, user.email, user.password)
+	return user
+}
+
+// 使用注册邮件中的token激活账户
+func (ts *testServer) activateUser(t *testing.T, user testUser) {
+	t.Helper()
+
+	token := ts.mailValue(t, user.email, "user_welcome.tmpl", "activationToken")
+	ts.expect(t, testRequest{
+		method: http.MethodPut,
+		path:   "/v1/users/activated",
+		body:   map[string]string{"token": token},
+	}, http.StatusOK)
+}
+
+// 注册并激活，返回的用户已登录
+func (ts *testServer) createUser(t *testing.T, name string) testUser {
+	t.Helper()
+
+	user := ts.registerUser(t, name)
+	ts.activateUser(t, user)
+	// 携带claims的jwt中有激活状态，激活后重新登录
+	user.token = ts.authenticate(t, user.email, user.password)
+	return user
+}
+
+// 使用邮箱和密码登录，返回access token
+func (ts *testServer) authenticate(t *testing.T, email, password string) string {
+	t.Helper()
+
+	res := ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/authentication",
+		body:   map[string]string{"email": email, "password": password},
+	}, http.StatusCreated)
+	return jsonString(t, res.body, "authentication_token")
+}
+
+// 登录时指定组织，返回的access token在没有X-Organization-ID header的请求中使用该组织
+func (ts *testServer) authenticateIn(t *testing.T, user testUser, orgID int64) string {
+	t.Helper()
+
+	res := ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/authentication",
+		body:   map[string]interface{}{"email": user.email, "password": user.password, "organization_id": orgID},
+	}, http.StatusCreated)
+	return jsonString(t, res.body, "authentication_token")
+}
+
+// 直接通过models给用户添加全局角色，例如admin
+func (ts *testServer) addRole(t *testing.T, user testUser, role string) {
+	t.Helper()
+
+	err := ts.app.models.RoleModel.AddForUser(context.Background(), user.id, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 按路径取出json中的值
+func jsonValue(t *testing.T, body map[string]interface{}, path ...string) interface{} {
+	t.Helper()
+
+	var value interface{} = body
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			t.Fatalf("%v: %q is not an object", body, key)
+		}
+		value, ok = object[key]
+		if !ok {
+			t.Fatalf("%v: missing %q", body, key)
+		}
+	}
+	return value
+}
+
+func jsonString(t *testing.T, body map[string]interface{}, path ...string) string {
+	t.Helper()
+
+	value, ok := jsonValue(t, body, path...).(string)
+	if !ok {
+		t.Fatalf("%v: %v is not a string", body, path)
+	}
+	return value
+}
+
+func jsonInt(t *testing.T, body map[string]interface{}, path ...string) int64 {
+	t.Helper()
+
+	value, ok := jsonValue(t, body, path...).(float64)
+	if !ok {
+		t.Fatalf("%v: %v is not a number", body, path)
+	}
+	return int64(value)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"strconv"
@@ -11,11 +12,15 @@ import (
 	"github.com/pascaldekloe/jwt"
 )
 
+const magicLinkTTL = 15 * time.Minute
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
-	// 验证请求体反序列化
+	// 验证请求体反序列化，email/password与magic_token二选一
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email          string `json:"email"`
+		Password       string `json:"password"`
+		MagicToken     string `json:"magic_token"`
+		OrganizationID int64  `json:"organization_id"`
 	}
 	err := app.readJson(w, r, &input)
 	if err != nil {
@@ -23,66 +28,393 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	v := validator.New()
+	if app.validateOrganizationClaim(v, input.OrganizationID); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	var user *data.User
+	if input.MagicToken != "" {
+		user = app.authenticateMagicToken(w, r, input.MagicToken)
+	} else {
+		user = app.authenticatePassword(w, r, input.Email, input.Password)
+	}
+	if user == nil {
+		return
+	}
+
+	// 启用了两步验证的用户，身份校验通过后只签发短期的mfa-pending token，
+	// 需要再通过 POST /v1/tokens/mfa 提交验证码才能拿到access token
+	mfa, err := app.mfaEnabled(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if mfa {
+		var token *data.Token
+		err = app.models.WithTx(r.Context(), func(m data.Models) error {
+			token, err = m.TokenModel.New(r.Context(), user.ID, mfaPendingTTL, data.ScopeMFAPending)
+			if err != nil {
+				return err
+			}
+
+			entry := app.newAuditEntry(r, "token.mfa_challenge", "user", user.ID, nil, nil)
+			entry.ActorID = user.ID
+			return m.AuditModel.Insert(r.Context(), entry)
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJson(w, http.StatusAccepted, envelope{"mfa_required": true, "mfa_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// 签发access token以及refresh token
+	tokens, err := app.loginUser(r, user, input.OrganizationID)
+	if err != nil {
+		app.issueTokensErrorResponse(w, r, err)
+		return
+	}
+
+	// 返回token响应
+	err = app.writeJson(w, http.StatusCreated, tokens, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+}
+
+// 校验email和密码，失败时写入响应并返回nil
+func (app *application) authenticatePassword(w http.ResponseWriter, r *http.Request, email, password string) *data.User {
 	// 验证请求体valid
 	v := validator.New()
-	data.ValidEmail(v, input.Email)
-	data.ValidPasswordPlaintext(v, input.Password)
+	data.ValidEmail(v, email)
+	data.ValidPasswordInput(v, password)
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.FieldErrors)
-		return
+		return nil
+	}
+
+	// 按账户限制失败次数，防止针对单个账户的分布式暴力破解
+	attemptKey := emailAttemptKey("login", email)
+	if !app.checkLockout(w, r, attemptKey) {
+		return nil
 	}
 
 	// 查询用户
-	user, err := app.models.UserModel.GetByEmail(input.Email)
+	user, err := app.models.UserModel.GetByEmail(r.Context(), email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
+			app.failedLoginResponse(w, r, attemptKey)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
-		return
+		return nil
 	}
 
 	// 验证密码
-	matches, err := user.Password.Matches(input.Password)
+	matches, err := user.Password.Matches(password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
+		return nil
 	}
 
 	if !matches {
-		app.invalidCredentialsResponse(w, r)
-		return
+		app.failedLoginResponse(w, r, attemptKey)
+		return nil
 	}
 
-	// 使用jwt token
-	var claims jwt.Claims
-	claims.Subject = strconv.FormatInt(user.ID, 10)
-	claims.Issued = jwt.NewNumericTime(time.Now())
-	claims.NotBefore = jwt.NewNumericTime(time.Now())
-	claims.Expires = jwt.NewNumericTime(time.Now().Add(24 * time.Hour))
-	claims.Issuer = "greenlight.xyz"
-	claims.Audiences = []string{"greenlight.xyz"}
-	token, err := claims.HMACSign(jwt.HS256, []byte(app.config.jwt.secret))
+	err = app.clearFailedAttempts(r.Context(), attemptKey)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return nil
+	}
+
+	// 只有登录时才能拿到明文密码，此时把旧算法或旧参数的哈希升级为当前配置；
+	// 超过当前算法长度上限的密码保留原来的哈希
+	if user.Password.NeedsRehash() && data.PasswordFitsAlgorithm(password) {
+		err = user.Password.Set(password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return nil
+		}
+
+		err = app.models.UserModel.Update(r.Context(), user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				// 并发修改时放弃本次升级，下次登录再试
+				app.logger.PrintWarning("password rehash skipped due to edit conflict", map[string]string{
+					"user_id": strconv.FormatInt(user.ID, 10),
+				})
+			default:
+				app.serverErrorResponse(w, r, err)
+				return nil
+			}
+		}
+	}
+	return user
+}
+
+// 兑换magic link token，token只能使用一次，失败时写入响应并返回nil
+func (app *application) authenticateMagicToken(w http.ResponseWriter, r *http.Request, tokenPlaintext string) *data.User {
+	v := validator.New()
+	v.Check(len(tokenPlaintext) == 26, "magic_token", "must be 26 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return nil
+	}
+
+	user, err := app.models.UserModel.GetForToken(r.Context(), data.ScopeMagicLink, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	// 以删除成功作为兑换成功，并发提交同一个token时只有一个请求能通过
+	err = app.models.TokenModel.Consume(r.Context(), data.ScopeMagicLink, user.ID, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return user
+}
+
+// 登录成功：签发token并记录审计日志
+func (app *application) loginUser(r *http.Request, user *data.User, orgID int64) (envelope, error) {
+	var tokens envelope
+	err := app.models.WithTx(r.Context(), func(m data.Models) error {
+		var err error
+		tokens, err = app.issueAuthenticationTokens(r.Context(), m, user, "", orgID)
+		if err != nil {
+			return err
+		}
+
+		entry := app.newAuditEntry(r, "token.create", "user", user.ID, nil, nil)
+		entry.ActorID = user.ID
+		return m.AuditModel.Insert(r.Context(), entry)
+	})
+	return tokens, err
+}
+
+// 签发短期的access token，以及与之配对、可轮换的refresh token
+// 启用了jwt认证时access token为jwt，否则为保存在tokens表中的不透明token
+// family为空表示一次新的登录，否则沿用被轮换掉的refresh token的family
+// orgID不为0时jwt携带org claim，请求没有X-Organization-ID header时使用该组织；用户不是组织成员时返回ErrNotMember
+func (app *application) issueAuthenticationTokens(ctx context.Context, m data.Models, user *data.User, family string, orgID int64) (envelope, error) {
+	var accessToken string
+	if app.authMethodEnabled("jwt") {
+		var claims jwt.Claims
+		claims.Subject = strconv.FormatInt(user.ID, 10)
+		claims.Issued = jwt.NewNumericTime(time.Now())
+		claims.NotBefore = jwt.NewNumericTime(time.Now())
+		claims.Expires = jwt.NewNumericTime(time.Now().Add(app.config.jwt.accessTTL))
+		claims.Issuer = "greenlight.xyz"
+		claims.Audiences = []string{"greenlight.xyz"}
+		claims.Set = map[string]interface{}{
+			"gen": user.TokenGeneration,
+		}
+
+		var membership *data.Membership
+		if orgID != 0 {
+			var err error
+			membership, err = m.OrganizationModel.GetMembership(ctx, orgID, user.ID)
+			if err != nil {
+				if errors.Is(err, data.ErrRecordNotFound) {
+					return nil, ErrNotMember
+				}
+				return nil, err
+			}
+			claims.Set["org"] = orgID
+		}
+
+		// 权限和激活状态写入claims，本服务校验权限时无需查询数据库，
+		// 通过jwks离线校验jwt的其他服务也可以直接使用；指定了组织时为组织内的有效权限（Membership.ScopePermissions）
+		if app.config.jwt.embedClaims {
+			permissions, err := m.PermisionModel.GetAllForUser(ctx, user.ID)
+			if err != nil {
+				return nil, err
+			}
+			if membership != nil {
+				permissions = membership.ScopePermissions(permissions)
+			}
+			if permissions == nil {
+				permissions = data.Permisions{}
+			}
+			claims.Set["perms"] = permissions
+			claims.Set["act"] = user.Activated
+		}
+		token, err := app.keyring.Sign(&claims)
+		if err != nil {
+			return nil, err
+		}
+		accessToken = string(token)
+	} else {
+		token, err := m.TokenModel.New(ctx, user.ID, app.config.jwt.accessTTL, data.ScopeAuthentication)
+		if err != nil {
+			return nil, err
+		}
+		accessToken = token.Plaintext
+	}
+
+	refreshToken, err := m.TokenModel.NewRefresh(ctx, user.ID, app.config.jwt.refreshTTL, family)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope{
+		"authentication_token": accessToken,
+		"refresh_token":        refreshToken,
+	}, nil
+}
+
+// 只有jwt能携带组织，不透明token和api key需要通过X-Organization-ID header指定组织
+func (app *application) validateOrganizationClaim(v *validator.Validator, orgID int64) {
+	v.Check(orgID >= 0, "organization_id", "must be a positive integer")
+	v.Check(orgID == 0 || app.authMethodEnabled("jwt"), "organization_id", "can only be set when jwt authentication is enabled")
+}
+
+func (app *application) issueTokensErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrNotMember):
+		app.failedValidationResponse(w, r, map[string]string{"organization_id": "must be an organization you are a member of"})
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 吊销用户所有的登录会话：jwt、不透明token以及refresh token（api key不受影响）
+func (app *application) revokeUserSessions(ctx context.Context, m data.Models, userID int64) error {
+	err := m.UserModel.RevokeTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	err = m.TokenModel.DeleteAllForUser(ctx, data.ScopeAuthentication, userID)
+	if err != nil {
+		return err
+	}
+
+	return m.TokenModel.DeleteAllForUser(ctx, data.ScopeRefresh, userID)
+}
+
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// 新的access token不会沿用之前的org claim，需要时重新指定organization_id
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		OrganizationID int64  `json:"organization_id"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatorToken(v, input.TokenPlaintext)
+	app.validateOrganizationClaim(v, input.OrganizationID)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
 		return
 	}
 
-	// // 为用户生成token
-	// token, err := app.models.TokenModel.New(user.ID, 24*3*time.Hour, data.ScopeAuthentication)
-	// if err != nil {
-	// 	app.serverErrorResponse(w, r, err)
-	// 	return
-	// }
+	// 兑换refresh token，每个refresh token只能使用一次
+	var token *data.Token
+	var tokens envelope
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		token, err = m.TokenModel.ConsumeRefresh(r.Context(), input.TokenPlaintext)
+		if err != nil {
+			return err
+		}
 
-	// 返回token响应
-	err = app.writeJson(w, http.StatusCreated, envelope{"authentication_token": string(token)}, nil)
+		user, err := m.UserModel.Get(r.Context(), token.UserID)
+		if err != nil {
+			return err
+		}
+
+		tokens, err = app.issueAuthenticationTokens(r.Context(), m, user, token.Family, input.OrganizationID)
+		if err != nil {
+			return err
+		}
+
+		entry := app.newAuditEntry(r, "token.refresh", "user", user.ID, nil, nil)
+		entry.ActorID = user.ID
+		return m.AuditModel.Insert(r.Context(), entry)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrTokenReused):
+			// 已使用过的refresh token被再次提交，说明token可能已经泄漏：
+			// 吊销整个family，同时让该用户已签发的access token全部失效
+			err = app.models.WithTx(r.Context(), func(m data.Models) error {
+				err := m.TokenModel.DeleteFamily(r.Context(), token.Family)
+				if err != nil {
+					return err
+				}
+
+				err = app.revokeUserSessions(r.Context(), m, token.UserID)
+				if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+					return err
+				}
+
+				return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "token.reuse_detected", "user", token.UserID, nil, nil))
+			})
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.issueTokensErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJson(w, http.StatusCreated, tokens, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
+}
+
+// 登出：吊销该用户所有的登录会话
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getContextUser(r)
 
+	err := app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := app.revokeUserSessions(r.Context(), m, user.ID)
+		if err != nil {
+			return err
+		}
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "token.revoke", "user", user.ID, nil, nil))
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "logged out successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -104,43 +436,118 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
-	// 查询用户
-	user, err := app.models.UserModel.GetByEmail(input.Email)
-	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddFieldError("email", "no matching email found")
-			app.failedValidationResponse(w, r, v.FieldErrors)
-		default:
+	// 每次请求都会发送邮件，按账户限制发送频率；请求本身不是失败的认证，不计入失败次数
+	if !app.limitSends(w, r, emailAttemptKey("password-reset", input.Email)) {
+		return
+	}
+
+	// 无论账户是否存在、是否激活都返回同样的响应，避免泄露账户信息
+	message := envelope{"message": "if an activated account exists for this email address, you will receive an email containing password reset instructions"}
+
+	user, err := app.models.UserModel.GetByEmail(r.Context(), input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// 只给已激活的账户生成token，并通过邮件发送
+	if user != nil && user.Activated {
+		var token *data.Token
+		err = app.models.WithTx(r.Context(), func(m data.Models) error {
+			token, err = m.TokenModel.New(r.Context(), user.ID, 4*time.Hour, data.ScopePasswordReset)
+			if err != nil {
+				return err
+			}
+			return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "token.password_reset", "user", user.ID, nil, nil))
+		})
+		if err != nil {
 			app.serverErrorResponse(w, r, err)
+			return
 		}
+
+		app.Background(func() {
+			data := map[string]interface{}{
+				"passwordResetToken": token.Plaintext,
+			}
+			err := app.mailer.Send(user.Email, "password_reset.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	err = app.writeJson(w, http.StatusAccepted, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 发送一次性的登录链接，用户无需密码即可登录
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
 		return
 	}
 
-	// 判断是否激活用户
-	if !user.Activated {
-		v.AddFieldError("email", "user account must be activated")
+	v := validator.New()
+	if data.ValidEmail(v, input.Email); !v.Valid() {
 		app.failedValidationResponse(w, r, v.FieldErrors)
 		return
 	}
 
-	// 是则进行生成一个临时token返回
-	token, err := app.models.TokenModel.New(user.ID, 4*time.Hour, data.ScopePasswordReset)
-	if err != nil {
+	// 每次请求都会发送邮件，按账户限制发送频率；请求本身不是失败的认证，不计入失败次数
+	if !app.limitSends(w, r, emailAttemptKey("magic-link", input.Email)) {
+		return
+	}
+
+	// 无论账户是否存在都返回同样的响应，避免泄露账户信息
+	message := envelope{"message": "if an activated account exists for this email address, you will receive an email containing a login link"}
+
+	user, err := app.models.UserModel.GetByEmail(r.Context(), input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	//
-	message := envelope{
-		"password_reset_token": token.Plaintext,
+	if user != nil && user.Activated {
+		var token *data.Token
+		err = app.models.WithTx(r.Context(), func(m data.Models) error {
+			// 只有最新发出的链接有效
+			err := m.TokenModel.DeleteAllForUser(r.Context(), data.ScopeMagicLink, user.ID)
+			if err != nil {
+				return err
+			}
+
+			token, err = m.TokenModel.New(r.Context(), user.ID, magicLinkTTL, data.ScopeMagicLink)
+			if err != nil {
+				return err
+			}
+			return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "token.magic_link", "user", user.ID, nil, nil))
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.Background(func() {
+			data := map[string]interface{}{
+				"magicToken": token.Plaintext,
+			}
+			err := app.mailer.Send(user.Email, "magic_link.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
 	}
 
-	err = app.writeJson(w, http.StatusCreated, message, nil)
+	err = app.writeJson(w, http.StatusAccepted, message, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-
 }
 
 func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -161,38 +568,58 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	// 查询用户
-	user, err := app.models.UserModel.GetByEmail(input.Email)
-	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddFieldError("email", "no matching email found")
-			app.failedValidationResponse(w, r, v.FieldErrors)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
+	// 每次请求都会发送邮件，按账户限制发送频率；请求本身不是失败的认证，不计入失败次数
+	if !app.limitSends(w, r, emailAttemptKey("activation", input.Email)) {
 		return
 	}
 
-	// 判断是否激活用户
-	if user.Activated {
-		v.AddFieldError("email", "user already activated")
-		app.failedValidationResponse(w, r, v.FieldErrors)
+	// 无论账户是否存在、是否已激活都返回同样的响应，避免泄露账户信息
+	message := envelope{"message": "if an unactivated account exists for this email address, you will receive an email containing activation instructions"}
+
+	user, err := app.models.UserModel.GetByEmail(r.Context(), input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// 是则进行生成一个临时token返回
-	token, err := app.models.TokenModel.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	// 只给未激活的账户生成token，并通过邮件发送
+	if user != nil && !user.Activated {
+		var token *data.Token
+		err = app.models.WithTx(r.Context(), func(m data.Models) error {
+			token, err = m.TokenModel.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
+			if err != nil {
+				return err
+			}
+			return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "token.activation", "user", user.ID, nil, nil))
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.Background(func() {
+			data := map[string]interface{}{
+				"activationToken": token.Plaintext,
+			}
+			err := app.mailer.Send(user.Email, "token_activation.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	err = app.writeJson(w, http.StatusAccepted, message, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
 	}
+}
 
-	message := envelope{
-		"activation_token": token.Plaintext,
-	}
+// 发布用于验签的公钥，其他服务可以离线校验greenlight签发的jwt
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "public, max-age=300")
 
-	err = app.writeJson(w, http.StatusCreated, message, nil)
+	err := app.writeJson(w, http.StatusOK, envelope{"keys": app.keyring.JWKS()}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/embracexyz/greenlight/internal/data"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMagicLink(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+	user := ts.createUser(t, "Alice")
+
+	ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/magic-link", body: map[string]string{"email": user.email}}, http.StatusAccepted)
+	token := ts.mailValue(t, user.email, "magic_link.tmpl", "magicToken")
+
+	res := ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/authentication", body: map[string]string{"magic_token": token}}, http.StatusCreated)
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: jsonString(t, res.body, "authentication_token")}, http.StatusOK)
+
+	// 链接只能使用一次
+	ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/authentication", body: map[string]string{"magic_token": token}}, http.StatusUnauthorized)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+	user := ts.createUser(t, "Alice")
+
+	res := ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/authentication",
+		body:   map[string]string{"email": user.email, "password": user.password},
+	}, http.StatusCreated)
+	first := jsonString(t, res.body, "refresh_token", "token")
+
+	res = ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/refresh", body: map[string]string{"token": first}}, http.StatusCreated)
+	second := jsonString(t, res.body, "refresh_token", "token")
+	access := jsonString(t, res.body, "authentication_token")
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: access}, http.StatusOK)
+
+	// 重放已使用的refresh token：整个family被吊销，已签发的access token也失效
+	ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/refresh", body: map[string]string{"token": first}}, http.StatusUnauthorized)
+	ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/refresh", body: map[string]string{"token": second}}, http.StatusUnauthorized)
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: access}, http.StatusUnauthorized)
+}
+
+func TestLogout(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+	user := ts.createUser(t, "Alice")
+	other := ts.authenticate(t, user.email, user.password)
+
+	ts.expect(t, testRequest{method: http.MethodDelete, path: "/v1/tokens/authentication", token: user.token}, http.StatusOK)
+
+	// 所有会话都被吊销
+	for _, token := range []string{user.token, other} {
+		res := ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: token}, http.StatusUnauthorized)
+		if res.header.Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("WWW-Authenticate = %q, want Bearer", res.header.Get("WWW-Authenticate"))
+		}
+	}
+	ts.authenticate(t, user.email, user.password)
+}
+
+// 连续失败先渐进延迟，达到上限后锁定账户
+func TestLoginLockout(t *testing.T) {
+	app := newTestApplication(t, func(cfg *config) {
+		cfg.lockout.policy.DelayAfter = 2
+		cfg.lockout.policy.MaxFailures = 3
+	})
+	ts := newTestServer(t, app)
+	user := ts.createUser(t, "Alice")
+
+	wrong := testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/authentication",
+		body:   map[string]string{"email": user.email, "password": "wrongpa55word"},
+	}
+	ts.expect(t, wrong, http.StatusUnauthorized)
+	ts.expect(t, wrong, http.StatusUnauthorized)
+
+	res := ts.expect(t, wrong, http.StatusTooManyRequests)
+	if res.header.Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+	// 延迟期间正确的密码同样被拒绝
+	ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/authentication",
+		body:   map[string]string{"email": user.email, "password": user.password},
+	}, http.StatusTooManyRequests)
+
+	// 其他账户不受影响
+	other := ts.createUser(t, "Bob")
+	ts.authenticate(t, other.email, other.password)
+}
+
+// 发送邮件的接口超过频率限制后返回429，但不会锁定账户，也不影响其他动作
+func TestSendLimit(t *testing.T) {
+	app := newTestApplication(t, func(cfg *config) {
+		cfg.sendLimit.Max = 2
+	})
+	ts := newTestServer(t, app)
+	user := ts.createUser(t, "Alice")
+
+	reset := testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/password-reset",
+		body:   map[string]string{"email": user.email},
+	}
+	ts.expect(t, reset, http.StatusAccepted)
+	ts.expect(t, reset, http.StatusAccepted)
+
+	res := ts.expect(t, reset, http.StatusTooManyRequests)
+	if res.header.Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+
+	// 其他动作分别计数，登录不受影响
+	ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/magic-link",
+		body:   map[string]string{"email": user.email},
+	}, http.StatusAccepted)
+	ts.authenticate(t, user.email, user.password)
+}
+
+// 长度上限取决于哈希算法，只在设置密码时检查：切换到bcrypt之后，
+// 之前设置的超过72字节的密码依然可以登录，新设置的密码则不能超过72字节
+func TestLoginLongPasswordAfterAlgorithmChange(t *testing.T) {
+	setPasswordParams := func(params data.PasswordParams) {
+		t.Helper()
+		if err := data.SetPasswordParams(params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bcryptParams := data.PasswordParams{Algorithm: data.PasswordAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}
+	t.Cleanup(func() { setPasswordParams(bcryptParams) })
+
+	setPasswordParams(data.PasswordParams{Algorithm: data.PasswordAlgorithmArgon2id, Argon2Time: 1, Argon2Memory: 8, Argon2Threads: 1})
+	ts := newTestServer(t, newTestApplication(t))
+	user := newTestUserInput("Alice")
+	user.password = strings.Repeat("pa55word", 12)
+	register := func(user testUser) testRequest {
+		return testRequest{
+			method: http.MethodPost,
+			path:   "/v1/users",
+			body:   map[string]string{"name": user.name, "email": user.email, "password": user.password},
+		}
+	}
+	ts.expect(t, register(user), http.StatusCreated)
+
+	setPasswordParams(bcryptParams)
+	// 第二次登录确认没有升级为截断的bcrypt哈希
+	ts.authenticate(t, user.email, user.password)
+	ts.authenticate(t, user.email, user.password)
+
+	other := newTestUserInput("Bob")
+	other.password = user.password
+	ts.expect(t, register(other), http.StatusUnprocessableEntity)
+}
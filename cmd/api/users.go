@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/data"
+	"github.com/embracexyz/greenlight/internal/validator"
+)
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadContextUser(r)
+	if err != nil {
+		app.loadContextUserErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.PermisionModel.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permisions{}
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 导出我们保存的与当前用户有关的所有数据，以附件的形式下载
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadContextUser(r)
+	if err != nil {
+		app.loadContextUserErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.PermisionModel.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// token只导出元数据，明文和hash都不会导出
+	tokens, err := app.models.TokenModel.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	type tokenMetadata struct {
+		Scope  string    `json:"scope"`
+		Expiry time.Time `json:"expiry"`
+	}
+	tokensMetadata := make([]tokenMetadata, 0, len(tokens))
+	for _, token := range tokens {
+		tokensMetadata = append(tokensMetadata, tokenMetadata{Scope: token.Scope, Expiry: token.Expiry})
+	}
+
+	apiKeys, err := app.models.APIKeyModel.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	mfa, err := app.mfaEnabled(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	auditEntries, err := app.models.AuditModel.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	orgs, err := app.models.OrganizationModel.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var pendingEmail *string
+	change, err := app.models.EmailChangeModel.Get(r.Context(), user.ID)
+	switch {
+	case err == nil:
+		pendingEmail = &change.NewEmail
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	archive := envelope{
+		"exported_at":   time.Now(),
+		"user":          user,
+		"permissions":   permissions,
+		"tokens":        tokensMetadata,
+		"api_keys":      apiKeys,
+		"two_factor":    mfa,
+		"pending_email": pendingEmail,
+		"organizations": orgs,
+		"audit":         auditEntries,
+	}
+
+	// 直接编码到ResponseWriter，不在内存中拼接完整的响应体
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-user-%d.json"`, user.ID))
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	err = enc.Encode(archive)
+	if err != nil {
+		// header已经发送，只能记录错误
+		app.logError(r, err)
+	}
+}
+
+// 删除当前账户，需要再次确认密码
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidPasswordInput(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	user, err := app.loadContextUser(r)
+	if err != nil {
+		app.loadContextUserErrorResponse(w, r, err)
+		return
+	}
+
+	matches, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !matches {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.UserModel.Delete(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+		// 不保存快照，删除后不再留下邮箱明文
+		return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "user.delete", "user", user.ID, nil, nil))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"message": "account deleted successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 修改当前用户的资料：name立即生效；email需要先到新邮箱确认后才会替换
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name  *string `json:"name"`
+		Email *string `json:"email"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	user, err := app.loadContextUser(r)
+	if err != nil {
+		app.loadContextUserErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.Name != nil {
+		data.ValidName(v, *input.Name)
+	}
+	if input.Email != nil {
+		data.ValidEmail(v, *input.Email)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	// email是citext，大小写不同视为同一个地址
+	changeName := input.Name != nil && *input.Name != user.Name
+	changeEmail := input.Email != nil && !strings.EqualFold(*input.Email, user.Email)
+
+	// 所有检查在写入之前完成，name和email要么一起修改，要么都不修改
+	if changeEmail {
+		_, err = app.models.UserModel.GetByEmail(r.Context(), *input.Email)
+		switch {
+		case err == nil:
+			v.AddFieldError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+			return
+		case !errors.Is(err, data.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	before := *user
+	if changeName {
+		user.Name = *input.Name
+	}
+
+	// 事务重试时从原来的版本号重新开始
+	version := user.Version
+	var token *data.Token
+	if changeName || changeEmail {
+		err = app.models.WithTx(r.Context(), func(m data.Models) error {
+			if changeName {
+				user.Version = version
+				err := m.UserModel.Update(r.Context(), user)
+				if err != nil {
+					return err
+				}
+				err = m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "user.update", "user", user.ID, auditUser(&before), auditUser(user)))
+				if err != nil {
+					return err
+				}
+			}
+			if !changeEmail {
+				return nil
+			}
+
+			err := m.EmailChangeModel.Insert(r.Context(), &data.EmailChange{UserID: user.ID, NewEmail: *input.Email})
+			if err != nil {
+				return err
+			}
+
+			// 只有最新一次修改请求的token有效
+			err = m.TokenModel.DeleteAllForUser(r.Context(), data.ScopeEmailChange, user.ID)
+			if err != nil {
+				return err
+			}
+
+			token, err = m.TokenModel.New(r.Context(), user.ID, 24*time.Hour, data.ScopeEmailChange)
+			if err != nil {
+				return err
+			}
+			// 不记录新邮箱，理由同auditUser
+			return m.AuditModel.Insert(r.Context(), app.newAuditEntry(r, "user.email_change_request", "user", user.ID, nil, nil))
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	message := envelope{"user": user}
+
+	if changeEmail {
+		oldEmail, newEmail := user.Email, *input.Email
+		app.Background(func() {
+			err := app.mailer.Send(newEmail, "email_change_confirm.tmpl", map[string]interface{}{
+				"emailChangeToken": token.Plaintext,
+			})
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+
+			// 通知旧邮箱，账户被盗用时用户可以及时发现
+			err = app.mailer.Send(oldEmail, "email_change_notice.tmpl", map[string]interface{}{
+				"newEmail": newEmail,
+			})
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+
+		message["pending_email"] = newEmail
+	}
+
+	err = app.writeJson(w, http.StatusOK, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// 兑换email-change token，替换为待确认的新邮箱
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJson(w, r, &input)
+	if err != nil {
+		app.badRequestErrorReponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidatorToken(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.FieldErrors)
+		return
+	}
+
+	user, err := app.models.UserModel.GetForToken(r.Context(), data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddFieldError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	change, err := app.models.EmailChangeModel.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddFieldError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// 请求修改之后，新邮箱可能已经被其他账户注册或确认，由唯一约束兜底
+	before := *user
+	user.Email = change.NewEmail
+	version := user.Version
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		user.Version = version
+		err := m.UserModel.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		err = m.EmailChangeModel.Delete(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+
+		err = m.TokenModel.DeleteAllForUser(r.Context(), data.ScopeEmailChange, user.ID)
+		if err != nil {
+			return err
+		}
+
+		entry := app.newAuditEntry(r, "user.email_change", "user", user.ID, auditUser(&before), auditUser(user))
+		entry.ActorID = user.ID
+		return m.AuditModel.Insert(r.Context(), entry)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddFieldError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.FieldErrors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
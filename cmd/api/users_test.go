@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUserLifecycle(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+
+	user := ts.registerUser(t, "Alice")
+
+	// 未激活时只能查看自己的资料
+	res := ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: user.token}, http.StatusOK)
+	if jsonValue(t, res.body, "user", "activated") != false {
+		t.Errorf("new user is activated: %v", res.body)
+	}
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/organizations", token: user.token}, http.StatusForbidden)
+
+	// 激活token只能使用一次
+	token := ts.mailValue(t, user.email, "user_welcome.tmpl", "activationToken")
+	ts.expect(t, testRequest{method: http.MethodPut, path: "/v1/users/activated", body: map[string]string{"token": token}}, http.StatusOK)
+	ts.expect(t, testRequest{method: http.MethodPut, path: "/v1/users/activated", body: map[string]string{"token": token}}, http.StatusUnprocessableEntity)
+
+	// 注册时创建了个人组织，用户是组织的owner
+	res = ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/organizations", token: user.token}, http.StatusOK)
+	orgs := jsonValue(t, res.body, "organizations").([]interface{})
+	if len(orgs) != 1 || orgs[0].(map[string]interface{})["role"] != "owner" {
+		t.Errorf("organizations = %v, want one owned organization", orgs)
+	}
+
+	// 修改邮箱需要确认新邮箱，同时通知旧邮箱
+	res = ts.expect(t, testRequest{
+		method: http.MethodPatch,
+		path:   "/v1/users/me",
+		token:  user.token,
+		body:   map[string]string{"email": "alice@example.org"},
+	}, http.StatusOK)
+	if jsonString(t, res.body, "pending_email") != "alice@example.org" {
+		t.Errorf("pending_email = %v", res.body["pending_email"])
+	}
+	if newEmail := ts.mailValue(t, user.email, "email_change_notice.tmpl", "newEmail"); newEmail != "alice@example.org" {
+		t.Errorf("notice sent for %q", newEmail)
+	}
+	token = ts.mailValue(t, "alice@example.org", "email_change_confirm.tmpl", "emailChangeToken")
+	res = ts.expect(t, testRequest{method: http.MethodPut, path: "/v1/users/email", body: map[string]string{"token": token}}, http.StatusOK)
+	if jsonString(t, res.body, "user", "email") != "alice@example.org" {
+		t.Errorf("email = %v", res.body)
+	}
+	ts.authenticate(t, "alice@example.org", user.password)
+
+	// 导出的数据不包含任何token的明文
+	res = ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me/export", token: user.token}, http.StatusOK)
+	if !strings.HasPrefix(res.header.Get("Content-Disposition"), "attachment;") {
+		t.Errorf("Content-Disposition = %q", res.header.Get("Content-Disposition"))
+	}
+	for _, tk := range jsonValue(t, res.body, "tokens").([]interface{}) {
+		if _, ok := tk.(map[string]interface{})["token"]; ok {
+			t.Errorf("export contains a token plaintext: %v", tk)
+		}
+	}
+
+	// 删除账户后token随之失效
+	ts.expect(t, testRequest{method: http.MethodDelete, path: "/v1/users/me", token: user.token, body: map[string]string{"password": user.password}}, http.StatusOK)
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: user.token}, http.StatusUnauthorized)
+	ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/authentication",
+		body:   map[string]string{"email": "alice@example.org", "password": user.password},
+	}, http.StatusUnauthorized)
+}
+
+func TestUpdateEmailDuplicate(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+	alice := ts.createUser(t, "Alice")
+	bob := ts.createUser(t, "Bob")
+
+	// 邮箱不区分大小写；邮箱冲突时同一请求中的name也不会修改
+	ts.expect(t, testRequest{
+		method: http.MethodPatch,
+		path:   "/v1/users/me",
+		token:  alice.token,
+		body:   map[string]string{"name": "Alicia", "email": strings.ToUpper(bob.email)},
+	}, http.StatusUnprocessableEntity)
+
+	res := ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: alice.token}, http.StatusOK)
+	if name := jsonString(t, res.body, "user", "name"); name != alice.name {
+		t.Errorf("name = %q, want %q", name, alice.name)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+	user := ts.createUser(t, "Alice")
+
+	ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/password-reset", body: map[string]string{"email": user.email}}, http.StatusAccepted)
+	token := ts.mailValue(t, user.email, "password_reset.tmpl", "passwordResetToken")
+
+	ts.expect(t, testRequest{
+		method: http.MethodPut,
+		path:   "/v1/users/password",
+		body:   map[string]string{"password": "newpa55word1234", "token": token},
+	}, http.StatusOK)
+
+	// 重置前签发的token失效，只有新密码可以登录
+	ts.expect(t, testRequest{method: http.MethodGet, path: "/v1/users/me", token: user.token}, http.StatusUnauthorized)
+	ts.expect(t, testRequest{
+		method: http.MethodPost,
+		path:   "/v1/tokens/authentication",
+		body:   map[string]string{"email": user.email, "password": user.password},
+	}, http.StatusUnauthorized)
+	ts.authenticate(t, user.email, "newpa55word1234")
+
+	// token只能使用一次
+	ts.expect(t, testRequest{
+		method: http.MethodPut,
+		path:   "/v1/users/password",
+		body:   map[string]string{"password": "otherpa55word1234", "token": token},
+	}, http.StatusUnprocessableEntity)
+}
+
+// 未激活和不存在的账户得到同样的响应，但不会收到邮件
+func TestPasswordResetUnknownAccount(t *testing.T) {
+	ts := newTestServer(t, newTestApplication(t))
+	inactive := ts.registerUser(t, "Inactive")
+
+	for _, email := range []string{inactive.email, "nobody@example.com"} {
+		ts.expect(t, testRequest{method: http.MethodPost, path: "/v1/tokens/password-reset", body: map[string]string{"email": email}}, http.StatusAccepted)
+		ts.app.wg.Wait()
+		if _, ok := ts.mailer.last(email, "password_reset.tmpl"); ok {
+			t.Errorf("password reset email sent to %s", email)
+		}
+	}
+}
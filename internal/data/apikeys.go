@@ -0,0 +1,175 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/validator"
+)
+
+// 所有api key都以该前缀开头，方便在Authorization header中与jwt、token区分
+const APIKeyPrefix = "glk_"
+
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Plaintext  string     `json:"key,omitempty"` // 只在创建时返回一次
+	Hash       []byte     `json:"-"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func ValidateAPIKeyName(v *validator.Validator, name string) {
+	v.Check(name != "", "name", "must be provided")
+	v.Check(len(name) <= 100, "name", "must not be more than 100 bytes long")
+}
+
+func IsAPIKey(plaintext string) bool {
+	return strings.HasPrefix(plaintext, APIKeyPrefix)
+}
+
+type APIKeyModel struct {
+	DB dbtx
+}
+
+func NewAPIKeyModel(db dbtx) APIKeyModel {
+	return APIKeyModel{DB: db}
+}
+
+func generateAPIKey(userID int64, name string) (*APIKey, error) {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &APIKey{
+		UserID:    userID,
+		Name:      name,
+		Plaintext: APIKeyPrefix + randomString(randomBytes),
+	}
+	// 保存前缀用于展示，帮助用户识别是哪一个key
+	key.Prefix = key.Plaintext[:len(APIKeyPrefix)+8]
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+	return key, nil
+}
+
+func (m APIKeyModel) New(ctx context.Context, userID int64, name string) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+	args := []interface{}{key.UserID, key.Name, key.Prefix, key.Hash}
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, user_id, created_at, name, prefix, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err = rows.Scan(&key.ID, &key.UserID, &key.CreatedAt, &key.Name, &key.Prefix, &key.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// 只能删除属于自己的key
+func (m APIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 根据key查询用户，同时更新key的最近使用时间
+func (m APIKeyModel) GetUserForKey(ctx context.Context, plaintext string) (*User, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+		WITH key AS (
+			UPDATE api_keys SET last_used_at = NOW()
+			WHERE hash = $1
+			RETURNING user_id
+		)
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.token_generation
+		FROM users
+		INNER JOIN key ON users.id = key.user_id`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var user User
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(&user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version, &user.TokenGeneration)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
@@ -0,0 +1,170 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// 失败尝试的锁定策略
+type LockoutPolicy struct {
+	Window      time.Duration // 距上次失败超过该时间后，失败次数重新计数
+	DelayAfter  int           // 连续失败达到该次数后开始渐进延迟
+	BaseDelay   time.Duration // 第一次延迟的时长，之后每失败一次翻倍
+	MaxFailures int           // 连续失败达到该次数后锁定
+	Duration    time.Duration // 锁定时长
+}
+
+// 根据失败次数计算需要等待到什么时候
+func (p LockoutPolicy) lockedUntil(failures int, now time.Time) time.Time {
+	switch {
+	case p.MaxFailures > 0 && failures >= p.MaxFailures:
+		return now.Add(p.Duration)
+	case p.DelayAfter > 0 && failures >= p.DelayAfter:
+		delay := p.BaseDelay << (failures - p.DelayAfter)
+		if delay <= 0 || delay > p.Duration {
+			delay = p.Duration
+		}
+		return now.Add(delay)
+	default:
+		return now
+	}
+}
+
+// 发送邮件等操作的频率限制：从窗口内的第一次发送开始计时，窗口内最多发送Max次；
+// 只限制频率，不锁定账户
+type SendLimit struct {
+	Window time.Duration
+	Max    int
+}
+
+// 某个key（例如 登录邮箱）上的失败尝试记录
+type Attempts struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// 是否处于锁定（或渐进延迟）中
+func (a *Attempts) Locked(now time.Time) bool {
+	return a.LockedUntil.After(now)
+}
+
+type AttemptModel struct {
+	DB dbtx
+}
+
+func NewAttemptModel(db dbtx) AttemptModel {
+	return AttemptModel{DB: db}
+}
+
+func (m AttemptModel) Get(ctx context.Context, key string) (*Attempts, error) {
+	query := `
+		SELECT key, failures, last_failure_at, locked_until
+		FROM auth_attempts
+		WHERE key = $1`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var attempts Attempts
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(&attempts.Key, &attempts.Failures, &attempts.LastFailureAt, &attempts.LockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &attempts, nil
+}
+
+// 记录一次失败，并按策略计算锁定时间；计数和锁定时间在同一条语句中写入，
+// 并发的失败不会丢失计数，也不会用较少的失败次数覆盖锁定时间
+func (m AttemptModel) RecordFailure(ctx context.Context, key string, policy LockoutPolicy) (*Attempts, error) {
+	now := time.Now()
+	query := `
+		INSERT INTO auth_attempts (key, failures, last_failure_at, locked_until)
+		VALUES ($1, 1, $2, $4)
+		ON CONFLICT (key) DO UPDATE
+		SET (failures, last_failure_at, locked_until) = (
+			SELECT counted.failures, $2, CASE
+					WHEN $5::integer > 0 AND counted.failures >= $5::integer
+						THEN $2 + $6::float8 * interval '1 second'
+					WHEN $7::integer > 0 AND counted.failures >= $7::integer
+						THEN $2 + least($6::float8, $8::float8 * power(2, counted.failures - $7::integer)) * interval '1 second'
+					ELSE $2
+				END
+			FROM (
+				SELECT CASE
+					WHEN auth_attempts.last_failure_at < $3 THEN 1
+					ELSE auth_attempts.failures + 1
+				END AS failures
+			) AS counted
+		)
+		RETURNING failures, locked_until`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	args := []interface{}{
+		key, now, now.Add(-policy.Window),
+		// 第一次失败（插入）时的锁定时间
+		policy.lockedUntil(1, now),
+		policy.MaxFailures, policy.Duration.Seconds(),
+		policy.DelayAfter, policy.BaseDelay.Seconds(),
+	}
+	attempts := &Attempts{
+		Key:           key,
+		LastFailureAt: now,
+	}
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&attempts.Failures, &attempts.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// 记录一次发送，failures为当前窗口内的发送次数（包括本次），last_failure_at为窗口开始的时间；
+// 不修改locked_until，发送次数不会导致账户锁定
+func (m AttemptModel) RecordSend(ctx context.Context, key string, limit SendLimit) (*Attempts, error) {
+	now := time.Now()
+	query := `
+		INSERT INTO auth_attempts (key, failures, last_failure_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+				WHEN auth_attempts.last_failure_at < $3 THEN 1
+				ELSE auth_attempts.failures + 1
+			END,
+			last_failure_at = CASE
+				WHEN auth_attempts.last_failure_at < $3 THEN EXCLUDED.last_failure_at
+				ELSE auth_attempts.last_failure_at
+			END
+		RETURNING failures, last_failure_at, locked_until`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	attempts := &Attempts{Key: key}
+	err := m.DB.QueryRowContext(ctx, query, key, now, now.Add(-limit.Window)).Scan(&attempts.Failures, &attempts.LastFailureAt, &attempts.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// 成功后清除失败记录
+func (m AttemptModel) Clear(ctx context.Context, key string) error {
+	query := `
+		DELETE FROM auth_attempts WHERE key = $1`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
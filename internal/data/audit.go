@@ -0,0 +1,179 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/validator"
+)
+
+// 一次写操作的审计记录；actor_id不设外键，用户被删除后记录依然保留
+type AuditEntry struct {
+	ID           int64     `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	ActorID      int64     `json:"actor_id,omitempty"` // 0表示匿名请求
+	Action       string    `json:"action"`
+	ResourceType string    `json:"resource_type"`
+	ResourceID   string    `json:"resource_id,omitempty"`
+	// 写入时为任意可以json序列化的值，读出时为json.RawMessage
+	Before    interface{} `json:"before,omitempty"`
+	After     interface{} `json:"after,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	ClientIP  string      `json:"client_ip,omitempty"`
+}
+
+// 查询审计记录的过滤条件，零值表示不过滤
+type AuditFilter struct {
+	ActorID      int64
+	ResourceType string
+	ResourceID   string
+	Action       string
+	From         time.Time
+	To           time.Time
+}
+
+type AuditModel struct {
+	DB dbtx
+}
+
+func NewAuditModel(db dbtx) AuditModel {
+	return AuditModel{DB: db}
+}
+
+// 与被审计的修改使用同一个事务（通过Models.WithTx）写入
+func (m AuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	before, err := snapshot(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := snapshot(entry.After)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		insert into audit_log (actor_id, action, resource_type, resource_id, before, after, request_id, client_ip)
+		values (nullif($1, 0), $2, $3, $4, $5, $6, $7, $8)
+		returning id, created_at`
+
+	args := []interface{}{entry.ActorID, entry.Action, entry.ResourceType, entry.ResourceID, before, after, entry.RequestID, entry.ClientIP}
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+// nil快照保存为sql null
+func snapshot(v interface{}) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+func (m AuditModel) GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+		select count(*) over(), id, created_at, coalesce(actor_id, 0), action, resource_type, resource_id, before, after, request_id, client_ip
+		from audit_log
+		where (actor_id = $1 or $1 = 0)
+		and (resource_type = $2 or $2 = '')
+		and (resource_id = $3 or $3 = '')
+		and (action = $4 or $4 = '')
+		and (created_at >= $5 or $5::timestamptz is null)
+		and (created_at < $6 or $6::timestamptz is null)
+		order by %s %s, id DESC
+		limit $7 offset $8
+	`, filters.SortColumn(), filters.SortDirection())
+
+	args := []interface{}{filter.ActorID, filter.ResourceType, filter.ResourceID, filter.Action, nullTime(filter.From), nullTime(filter.To), filters.limit(), filters.offset()}
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err = scanAuditEntry(rows, &entry, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return entries, caclMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// 用户自己发起的操作，以及针对该用户的操作，用于数据导出
+func (m AuditModel) GetAllForUser(ctx context.Context, userID int64) ([]*AuditEntry, error) {
+	query := `
+		select id, created_at, coalesce(actor_id, 0), action, resource_type, resource_id, before, after, request_id, client_ip
+		from audit_log
+		where actor_id = $1 or (resource_type = 'user' and resource_id = $1::text)
+		order by created_at, id`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err = scanAuditEntry(rows, &entry)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// prefix为查询结果中排在审计字段之前的列（例如count(*) over()）
+func scanAuditEntry(rows *sql.Rows, entry *AuditEntry, prefix ...interface{}) error {
+	var before, after []byte
+	dest := append(prefix, &entry.ID, &entry.CreatedAt, &entry.ActorID, &entry.Action, &entry.ResourceType, &entry.ResourceID, &before, &after, &entry.RequestID, &entry.ClientIP)
+	err := rows.Scan(dest...)
+	if err != nil {
+		return err
+	}
+	if before != nil {
+		entry.Before = json.RawMessage(before)
+	}
+	if after != nil {
+		entry.After = json.RawMessage(after)
+	}
+	return nil
+}
+
+// 零值时间作为sql null，表示不过滤
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func ValidateAuditFilter(v *validator.Validator, filter AuditFilter) {
+	v.Check(filter.ActorID >= 0, "actor_id", "must be a positive integer")
+	v.Check(filter.From.IsZero() || filter.To.IsZero() || filter.From.Before(filter.To), "from", "must be before to")
+}
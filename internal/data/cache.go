@@ -0,0 +1,183 @@
+package data
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 进程内带过期时间的缓存，只用于按id查询的热点数据
+type ttlCache[K comparable, V any] struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[K]cacheItem[V]
+	// 下一次清理过期条目的时间
+	sweepAt time.Time
+}
+
+type cacheItem[V any] struct {
+	value  V
+	expiry time.Time
+}
+
+func newTTLCache[K comparable, V any](ttl time.Duration) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		ttl:     ttl,
+		items:   make(map[K]cacheItem[V]),
+		sweepAt: time.Now().Add(ttl),
+	}
+}
+
+func (c *ttlCache[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.items[key]
+	if !ok || time.Now().After(item.expiry) {
+		var zero V
+		return zero, false
+	}
+	return item.value, true
+}
+
+// 写入时每隔ttl顺带清理一次过期的条目，避免map无限增长，也不需要常驻的后台goroutine
+func (c *ttlCache[K, V]) set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.After(c.sweepAt) {
+		for key, item := range c.items {
+			if now.After(item.expiry) {
+				delete(c.items, key)
+			}
+		}
+		c.sweepAt = now.Add(c.ttl)
+	}
+	c.items[key] = cacheItem[V]{value: value, expiry: now.Add(c.ttl)}
+}
+
+func (c *ttlCache[K, V]) delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.items, key)
+}
+
+// 写操作之后使缓存失效：立即删除；在事务中时（afterCommit不为nil）提交后再删除一次，
+// 否则事务之外的并发请求可能在提交之前把旧数据重新写入缓存
+func (c *ttlCache[K, V]) invalidate(key K, afterCommit *[]func()) {
+	c.delete(key)
+	if afterCommit != nil {
+		*afterCommit = append(*afterCommit, func() { c.delete(key) })
+	}
+}
+
+// 给UserModel、PermisionModel和RoleModel加一层缓存；写操作会立即失效对应用户的缓存，
+// 多实例部署时其他实例最多在ttl之后看到变化
+func NewCachedModels(models Models, ttl time.Duration) Models {
+	users := newTTLCache[int64, User](ttl)
+	permissions := newTTLCache[int64, Permisions](ttl)
+
+	// 事务中读到的可能是未提交的数据，只做失效、不写入缓存
+	wrap := func(models Models, populate bool) Models {
+		models.UserModel = cachedUserModel{userStore: models.UserModel, users: users, permissions: permissions, populate: populate, afterCommit: models.afterCommit}
+		models.PermisionModel = cachedPermisionModel{permissionStore: models.PermisionModel, permissions: permissions, populate: populate, afterCommit: models.afterCommit}
+		models.RoleModel = cachedRoleModel{roleStore: models.RoleModel, permissions: permissions, afterCommit: models.afterCommit}
+		return models
+	}
+
+	models = wrap(models, true)
+	models.wrap = func(models Models) Models {
+		return wrap(models, false)
+	}
+	return models
+}
+
+type cachedUserModel struct {
+	userStore
+	users       *ttlCache[int64, User]
+	permissions *ttlCache[int64, Permisions]
+	populate    bool
+	afterCommit *[]func()
+}
+
+// 缓存的是值而不是指针，调用方修改返回的user不会影响缓存
+func (m cachedUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if user, ok := m.users.get(id); ok {
+		return &user, nil
+	}
+
+	user, err := m.userStore.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if m.populate {
+		m.users.set(id, *user)
+	}
+	return user, nil
+}
+
+func (m cachedUserModel) Update(ctx context.Context, user *User) error {
+	defer m.users.invalidate(user.ID, m.afterCommit)
+	return m.userStore.Update(ctx, user)
+}
+
+func (m cachedUserModel) RevokeTokens(ctx context.Context, userID int64) error {
+	defer m.users.invalidate(userID, m.afterCommit)
+	return m.userStore.RevokeTokens(ctx, userID)
+}
+
+func (m cachedUserModel) Delete(ctx context.Context, id int64) error {
+	defer m.users.invalidate(id, m.afterCommit)
+	defer m.permissions.invalidate(id, m.afterCommit)
+	return m.userStore.Delete(ctx, id)
+}
+
+type cachedPermisionModel struct {
+	permissionStore
+	permissions *ttlCache[int64, Permisions]
+	populate    bool
+	afterCommit *[]func()
+}
+
+func (m cachedPermisionModel) GetAllForUser(ctx context.Context, userID int64) (Permisions, error) {
+	if permissions, ok := m.permissions.get(userID); ok {
+		return append(Permisions(nil), permissions...), nil
+	}
+
+	permissions, err := m.permissionStore.GetAllForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if m.populate {
+		m.permissions.set(userID, append(Permisions(nil), permissions...))
+	}
+	return permissions, nil
+}
+
+func (m cachedPermisionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	defer m.permissions.invalidate(userID, m.afterCommit)
+	return m.permissionStore.AddForUser(ctx, userID, codes...)
+}
+
+func (m cachedPermisionModel) RemoveForUser(ctx context.Context, userID int64, code string) error {
+	defer m.permissions.invalidate(userID, m.afterCommit)
+	return m.permissionStore.RemoveForUser(ctx, userID, code)
+}
+
+type cachedRoleModel struct {
+	roleStore
+	permissions *ttlCache[int64, Permisions]
+	afterCommit *[]func()
+}
+
+func (m cachedRoleModel) AddForUser(ctx context.Context, userID int64, name string) error {
+	defer m.permissions.invalidate(userID, m.afterCommit)
+	return m.roleStore.AddForUser(ctx, userID, name)
+}
+
+func (m cachedRoleModel) RemoveForUser(ctx context.Context, userID int64, name string) error {
+	defer m.permissions.invalidate(userID, m.afterCommit)
+	return m.roleStore.RemoveForUser(ctx, userID, name)
+}
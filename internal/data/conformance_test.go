@@ -0,0 +1,633 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/validator"
+)
+
+// 同一组用例分别在进程内存储和PostgreSQL上运行，保证两者的行为一致。
+// 设置GREENLIGHT_TEST_DB_DSN（指向已执行过migrations的数据库）时才会运行PostgreSQL版本；
+// 每个用例使用自己创建的用户和组织，结束后删除，不依赖数据库中已有的数据
+var testDB *sql.DB
+
+func TestMain(m *testing.M) {
+	if dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN"); dsn != "" {
+		db, err := sql.Open("postgres", dsn)
+		if err == nil {
+			err = db.Ping()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "open test database: %v\n", err)
+			os.Exit(1)
+		}
+		testDB = db
+	}
+	os.Exit(m.Run())
+}
+
+type testBackend struct {
+	name      string
+	newModels func() Models
+}
+
+func testBackends() []testBackend {
+	backends := []testBackend{{name: "memory", newModels: NewMemoryModels}}
+	if testDB != nil {
+		backends = append(backends, testBackend{name: "postgres", newModels: func() Models { return NewModels(testDB) }})
+	}
+	return backends
+}
+
+// 在每个后端上运行test
+func runConformance(t *testing.T, test func(t *testing.T, m Models)) {
+	for _, backend := range testBackends() {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.newModels())
+		})
+	}
+}
+
+var testSeq atomic.Int64
+
+func newTestUser(t *testing.T, m Models) *User {
+	t.Helper()
+
+	user := &User{
+		Name:      "Test User",
+		Email:     fmt.Sprintf("test-%d-%d@example.com", time.Now().UnixNano(), testSeq.Add(1)),
+		Activated: true,
+	}
+	if err := user.Password.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.UserModel.Insert(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		err := m.UserModel.Delete(context.Background(), user.ID)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			t.Error(err)
+		}
+	})
+	return user
+}
+
+// 新建的组织中只有owner一个成员，电影列表不受其他用例的影响
+func newTestOrganization(t *testing.T, m Models, owner *User) *Organization {
+	t.Helper()
+
+	org := &Organization{Name: "Test Organization"}
+	if err := m.OrganizationModel.Insert(context.Background(), org, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if testDB != nil {
+		t.Cleanup(func() {
+			// 组织删除时级联删除其中的电影和成员关系
+			if _, err := testDB.Exec("delete from organizations where id = $1", org.ID); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	return org
+}
+
+func newTestMovie(t *testing.T, m Models, org *Organization, owner *User, title string, year int32, runtime Runtime, genres ...string) *Movie {
+	t.Helper()
+
+	movie := &Movie{
+		Title:          title,
+		Year:           year,
+		Runtime:        runtime,
+		Genres:         genres,
+		CreatedBy:      owner.ID,
+		OrganizationID: org.ID,
+		Language:       DefaultSearchLanguage,
+	}
+	if err := m.MovieModel.Insert(context.Background(), movie); err != nil {
+		t.Fatal(err)
+	}
+	return movie
+}
+
+func movieTitles(movies []*Movie) []string {
+	titles := make([]string, 0, len(movies))
+	for _, movie := range movies {
+		titles = append(titles, movie.Title)
+	}
+	return titles
+}
+
+func listFilters(sort string, pageSize int) Filters {
+	return Filters{
+		Page:         1,
+		PageSize:     pageSize,
+		Sort:         sort,
+		SortSafelist: []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"},
+	}
+}
+
+func TestMovieOptimisticLocking(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		owner := newTestUser(t, m)
+		org := newTestOrganization(t, m, owner)
+		movie := newTestMovie(t, m, org, owner, "Moana", 2016, 107, "animation")
+
+		first, err := m.MovieModel.Get(ctx, org.ID, movie.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := m.MovieModel.Get(ctx, org.ID, movie.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first.Title = "Moana 2"
+		if err := m.MovieModel.Update(ctx, first); err != nil {
+			t.Fatal(err)
+		}
+		if first.Version != movie.Version+1 {
+			t.Errorf("version = %d, want %d", first.Version, movie.Version+1)
+		}
+
+		second.Runtime = 100
+		if err := m.MovieModel.Update(ctx, second); !errors.Is(err, ErrEditConflict) {
+			t.Errorf("stale update: got %v, want ErrEditConflict", err)
+		}
+
+		stored, err := m.MovieModel.Get(ctx, org.ID, movie.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Title != "Moana 2" || stored.Runtime != 107 {
+			t.Errorf("stored movie = %q %d, want the first update only", stored.Title, stored.Runtime)
+		}
+
+		// 其他组织看不到这部电影
+		if _, err := m.MovieModel.Get(ctx, org.ID+1000000, movie.ID); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("get from another organization: got %v, want ErrRecordNotFound", err)
+		}
+	})
+}
+
+func TestUserDuplicateEmail(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		user := newTestUser(t, m)
+
+		tests := []struct {
+			name  string
+			email string
+		}{
+			{"same address", user.Email},
+			{"different case", strings.ToUpper(user.Email)},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				duplicate := &User{Name: "Duplicate", Email: tt.email}
+				if err := duplicate.Password.Set("pa55word1234"); err != nil {
+					t.Fatal(err)
+				}
+				if err := m.UserModel.Insert(ctx, duplicate); !errors.Is(err, ErrDuplicateEmail) {
+					t.Errorf("got %v, want ErrDuplicateEmail", err)
+				}
+			})
+		}
+
+		// 修改为其他用户的邮箱同样冲突
+		other := newTestUser(t, m)
+		other.Email = user.Email
+		if err := m.UserModel.Update(ctx, other); !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("update: got %v, want ErrDuplicateEmail", err)
+		}
+	})
+}
+
+// 重复的code只授予一次；任何一个code不存在时都不授予
+func TestPermissionAddForUser(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+
+		tests := []struct {
+			name    string
+			codes   []string
+			wantErr error
+			want    Permisions
+		}{
+			{"single", []string{"admin:read"}, nil, Permisions{"admin:read"}},
+			{"duplicates", []string{"admin:read", "admin:write", "admin:read"}, nil, Permisions{"admin:read", "admin:write"}},
+			{"unknown", []string{"admin:read", "admin:unknown", "admin:read"}, ErrRecordNotFound, Permisions{}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				user := newTestUser(t, m)
+				if err := m.PermisionModel.AddForUser(ctx, user.ID, tt.codes...); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				permissions, err := m.PermisionModel.GetAllForUser(ctx, user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				slices.Sort(permissions)
+				if !slices.Equal(permissions, tt.want) {
+					t.Errorf("permissions = %v, want %v", permissions, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestTokenExpiry(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		user := newTestUser(t, m)
+
+		valid, err := m.TokenModel.New(ctx, user.ID, time.Hour, ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired, err := m.TokenModel.New(ctx, user.ID, -time.Minute, ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := m.UserModel.GetForToken(ctx, ScopeAuthentication, valid.Plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != user.ID {
+			t.Errorf("user id = %d, want %d", got.ID, user.ID)
+		}
+
+		if _, err := m.UserModel.GetForToken(ctx, ScopeAuthentication, expired.Plaintext); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("expired token: got %v, want ErrRecordNotFound", err)
+		}
+		// token只在签发时的scope内有效
+		if _, err := m.UserModel.GetForToken(ctx, ScopeActivation, valid.Plaintext); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("wrong scope: got %v, want ErrRecordNotFound", err)
+		}
+	})
+}
+
+// 失败次数先触发渐进延迟，达到上限后锁定；并发记录的失败不会丢失
+func TestAttemptRecordFailure(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		policy := LockoutPolicy{Window: time.Hour, DelayAfter: 2, BaseDelay: time.Minute, MaxFailures: 4, Duration: time.Hour}
+		newKey := func() string {
+			key := fmt.Sprintf("test:%d-%d", time.Now().UnixNano(), testSeq.Add(1))
+			t.Cleanup(func() {
+				if err := m.AttemptModel.Clear(context.Background(), key); err != nil {
+					t.Error(err)
+				}
+			})
+			return key
+		}
+
+		key := newKey()
+		for i, wantDelay := range []time.Duration{0, time.Minute, 2 * time.Minute, time.Hour} {
+			attempts, err := m.AttemptModel.RecordFailure(ctx, key, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attempts.Failures != i+1 {
+				t.Errorf("failures = %d, want %d", attempts.Failures, i+1)
+			}
+			// 数据库中的时间精确到秒
+			delay := time.Until(attempts.LockedUntil)
+			if delay < wantDelay-2*time.Second || delay > wantDelay+time.Second {
+				t.Errorf("failure %d: locked for %v, want %v", i+1, delay, wantDelay)
+			}
+		}
+
+		key = newKey()
+		const concurrent = 8
+		errs := make(chan error, concurrent)
+		for range concurrent {
+			go func() {
+				_, err := m.AttemptModel.RecordFailure(ctx, key, policy)
+				errs <- err
+			}()
+		}
+		for range concurrent {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		attempts, err := m.AttemptModel.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts.Failures != concurrent || !attempts.Locked(time.Now().Add(policy.Duration-time.Minute)) {
+			t.Errorf("after %d concurrent failures: %d failures, locked until %v", concurrent, attempts.Failures, attempts.LockedUntil)
+		}
+	})
+}
+
+func TestMovieFilters(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		owner := newTestUser(t, m)
+		org := newTestOrganization(t, m, owner)
+		newTestMovie(t, m, org, owner, "The Godfather", 1972, 175, "crime", "drama")
+		newTestMovie(t, m, org, owner, "The Godfather Part II", 1974, 202, "crime", "drama")
+		newTestMovie(t, m, org, owner, "Heat", 1995, 170, "crime", "action")
+		newTestMovie(t, m, org, owner, "Father of the Bride", 1991, 105, "comedy")
+
+		tests := []struct {
+			name   string
+			filter MovieFilter
+			want   []string
+		}{
+			{"no filter", MovieFilter{}, []string{"The Godfather", "The Godfather Part II", "Heat", "Father of the Bride"}},
+			{"contains all genres", MovieFilter{Genres: []string{"crime", "drama"}}, []string{"The Godfather", "The Godfather Part II"}},
+			{"contains a missing genre", MovieFilter{Genres: []string{"crime", "comedy"}}, []string{}},
+			{"any genre", MovieFilter{GenresAny: []string{"action", "comedy"}}, []string{"Heat", "Father of the Bride"}},
+			{"excluded genre", MovieFilter{GenresNone: []string{"drama"}}, []string{"Heat", "Father of the Bride"}},
+			{"title word", MovieFilter{Title: "godfather"}, []string{"The Godfather", "The Godfather Part II"}},
+			{"title words", MovieFilter{Title: "godfather part"}, []string{"The Godfather Part II"}},
+			{"title matches whole words", MovieFilter{Title: "father"}, []string{"Father of the Bride"}},
+			{"year range", MovieFilter{YearMin: 1974, YearMax: 1991}, []string{"The Godfather Part II", "Father of the Bride"}},
+			{"runtime range", MovieFilter{RuntimeMin: 170, RuntimeMax: 180}, []string{"The Godfather", "Heat"}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				movies, _, err := m.MovieModel.GetAll(ctx, org.ID, tt.filter, listFilters("id", 20))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := movieTitles(movies); !slices.Equal(got, tt.want) {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+			})
+		}
+	})
+}
+
+// 沿着next_cursor逐页取出的顺序与一次取出全部的顺序一致，沿着prev_cursor可以翻回第一页
+func TestMovieCursorOrder(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		owner := newTestUser(t, m)
+		org := newTestOrganization(t, m, owner)
+		// 年份有重复，按id决定同一年份内的顺序
+		for i, year := range []int32{1999, 2003, 1999, 2010, 2003, 1999, 2021} {
+			newTestMovie(t, m, org, owner, fmt.Sprintf("Movie %d", i), year, Runtime(90+i), "drama")
+		}
+
+		for _, sort := range []string{"id", "-year", "title", "-runtime"} {
+			t.Run(sort, func(t *testing.T) {
+				all, _, err := m.MovieModel.GetAll(ctx, org.ID, MovieFilter{}, listFilters(sort, 20))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := movieTitles(all)
+
+				var got []string
+				var pages []Metadata
+				filters := listFilters(sort, 3)
+				for {
+					v := validator.New()
+					if ValidateFilters(v, &filters); !v.Valid() {
+						t.Fatal(v.FieldErrors)
+					}
+					movies, metadata, err := m.MovieModel.GetAll(ctx, org.ID, MovieFilter{}, filters)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, movieTitles(movies)...)
+					pages = append(pages, metadata)
+					if metadata.NextCursor == "" {
+						break
+					}
+					if len(pages) > len(want) {
+						t.Fatal("cursor pagination does not terminate")
+					}
+					filters = listFilters(sort, 3)
+					filters.After = metadata.NextCursor
+				}
+				if !slices.Equal(got, want) {
+					t.Fatalf("got %q, want %q", got, want)
+				}
+
+				// 从第二页向前翻回第一页
+				filters = listFilters(sort, 3)
+				filters.Before = pages[1].PrevCursor
+				v := validator.New()
+				if ValidateFilters(v, &filters); !v.Valid() {
+					t.Fatal(v.FieldErrors)
+				}
+				movies, _, err := m.MovieModel.GetAll(ctx, org.ID, MovieFilter{}, filters)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if first := movieTitles(movies); !slices.Equal(first, want[:3]) {
+					t.Errorf("previous page = %q, want %q", first, want[:3])
+				}
+			})
+		}
+	})
+}
+
+// 游标只能在签发时的过滤条件和组织下使用；游标分页默认不计算总数，要求计算时统计的是全部符合条件的电影
+func TestMovieCursorScope(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		owner := newTestUser(t, m)
+		org := newTestOrganization(t, m, owner)
+		other := newTestOrganization(t, m, owner)
+		for i := range 5 {
+			newTestMovie(t, m, org, owner, fmt.Sprintf("Drama %d", i), 2000, 90, "drama")
+		}
+		newTestMovie(t, m, org, owner, "Comedy", 2000, 90, "comedy")
+		drama := MovieFilter{Genres: []string{"drama"}}
+
+		_, first, err := m.MovieModel.GetAll(ctx, org.ID, drama, listFilters("id", 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := func(countCursor bool) Filters {
+			filters := listFilters("id", 2)
+			filters.After = first.NextCursor
+			filters.CountCursor = countCursor
+			v := validator.New()
+			if ValidateFilters(v, &filters); !v.Valid() {
+				t.Fatal(v.FieldErrors)
+			}
+			return filters
+		}
+
+		tests := []struct {
+			name    string
+			orgID   int64
+			filter  MovieFilter
+			wantErr error
+		}{
+			{"same filters", org.ID, drama, nil},
+			{"facets do not change the results", org.ID, MovieFilter{Genres: []string{"drama"}, Facets: []string{"genres"}}, nil},
+			{"different filters", org.ID, MovieFilter{}, ErrCursorMismatch},
+			{"different search", org.ID, MovieFilter{Genres: []string{"drama"}, Search: "drama", Language: DefaultSearchLanguage}, ErrCursorMismatch},
+			{"different organization", other.ID, drama, ErrCursorMismatch},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if _, _, err := m.MovieModel.GetAll(ctx, tt.orgID, tt.filter, next(false)); !errors.Is(err, tt.wantErr) {
+					t.Errorf("got %v, want %v", err, tt.wantErr)
+				}
+			})
+		}
+
+		_, metadata, err := m.MovieModel.GetAll(ctx, org.ID, drama, next(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.TotalRecords != 0 {
+			t.Errorf("total records without count = %d, want 0", metadata.TotalRecords)
+		}
+		_, metadata, err = m.MovieModel.GetAll(ctx, org.ID, drama, next(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.TotalRecords != 5 {
+			t.Errorf("total records = %d, want 5", metadata.TotalRecords)
+		}
+	})
+}
+
+func TestMovieFacets(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		owner := newTestUser(t, m)
+		org := newTestOrganization(t, m, owner)
+		newTestMovie(t, m, org, owner, "Alien", 1979, 117, "horror", "sci-fi")
+		newTestMovie(t, m, org, owner, "Aliens", 1986, 137, "action", "sci-fi")
+		newTestMovie(t, m, org, owner, "Arrival", 2016, 116, "drama", "sci-fi")
+		newTestMovie(t, m, org, owner, "Paddington", 2014, 95, "comedy")
+		newTestMovie(t, m, org, owner, "Short Film", 2019, 20, "drama")
+
+		want := map[string][]FacetCount{
+			"genres": {
+				{Value: "sci-fi", Count: 3},
+				{Value: "drama", Count: 2},
+				{Value: "action", Count: 1},
+				{Value: "comedy", Count: 1},
+				{Value: "horror", Count: 1},
+			},
+			"decade": {
+				{Value: "1970s", Min: 1970, Max: 1979, Count: 1},
+				{Value: "1980s", Min: 1980, Max: 1989, Count: 1},
+				{Value: "2010s", Min: 2010, Max: 2019, Count: 3},
+			},
+			"runtime": {
+				{Value: "0-89 mins", Max: 89, Count: 1},
+				{Value: "90-119 mins", Min: 90, Max: 119, Count: 3},
+				{Value: "120-149 mins", Min: 120, Max: 149, Count: 1},
+			},
+		}
+		facets := []string{"genres", "decade", "runtime"}
+
+		// 分面统计的是全部符合条件的电影，与当前页无关，超出最后一页时也一样
+		for _, page := range []int{1, 2, 10} {
+			t.Run(fmt.Sprintf("page %d", page), func(t *testing.T) {
+				filters := listFilters("id", 2)
+				filters.Page = page
+				_, metadata, err := m.MovieModel.GetAll(ctx, org.ID, MovieFilter{Facets: facets}, filters)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, facet := range facets {
+					if !slices.Equal(metadata.Facets[facet], want[facet]) {
+						t.Errorf("%s = %v, want %v", facet, metadata.Facets[facet], want[facet])
+					}
+				}
+			})
+		}
+
+		t.Run("filtered", func(t *testing.T) {
+			_, metadata, err := m.MovieModel.GetAll(ctx, org.ID, MovieFilter{Genres: []string{"sci-fi"}, Facets: []string{"decade"}}, listFilters("id", 20))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantDecade := []FacetCount{
+				{Value: "1970s", Min: 1970, Max: 1979, Count: 1},
+				{Value: "1980s", Min: 1980, Max: 1989, Count: 1},
+				{Value: "2010s", Min: 2010, Max: 2019, Count: 1},
+			}
+			if !slices.Equal(metadata.Facets["decade"], wantDecade) {
+				t.Errorf("decade = %v, want %v", metadata.Facets["decade"], wantDecade)
+			}
+			if _, ok := metadata.Facets["genres"]; ok {
+				t.Error("genres facet returned without being requested")
+			}
+		})
+
+		t.Run("no matches", func(t *testing.T) {
+			_, metadata, err := m.MovieModel.GetAll(ctx, org.ID, MovieFilter{Title: "nothing", Facets: []string{"genres"}}, listFilters("id", 20))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if genres, ok := metadata.Facets["genres"]; !ok || len(genres) != 0 {
+				t.Errorf("genres = %v, want an empty list", genres)
+			}
+		})
+	})
+}
+
+// 事务回滚只撤销事务自己的写入，事务进行期间在事务之外完成的写入不受影响
+func TestRollbackKeepsConcurrentWrites(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		owner := newTestUser(t, m)
+		org := newTestOrganization(t, m, owner)
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		txErr := make(chan error, 1)
+		go func() {
+			txErr <- m.WithTx(ctx, func(m Models) error {
+				movie := &Movie{Title: "Inside", Year: 2000, Runtime: 90, Genres: []string{"drama"}, CreatedBy: owner.ID, OrganizationID: org.ID, Language: DefaultSearchLanguage}
+				if err := m.MovieModel.Insert(ctx, movie); err != nil {
+					return err
+				}
+				close(started)
+				<-release
+				return errors.New("rollback")
+			})
+		}()
+
+		<-started
+		outsideErr := make(chan error, 1)
+		go func() {
+			movie := &Movie{Title: "Outside", Year: 2000, Runtime: 90, Genres: []string{"drama"}, CreatedBy: owner.ID, OrganizationID: org.ID, Language: DefaultSearchLanguage}
+			outsideErr <- m.MovieModel.Insert(ctx, movie)
+		}()
+		// 让事务之外的写入在事务回滚之前开始
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+
+		if err := <-txErr; err == nil || err.Error() != "rollback" {
+			t.Fatalf("transaction: got %v, want the rollback error", err)
+		}
+		if err := <-outsideErr; err != nil {
+			t.Fatal(err)
+		}
+
+		movies, _, err := m.MovieModel.GetAll(ctx, org.ID, MovieFilter{}, listFilters("id", 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := movieTitles(movies); !slices.Equal(got, []string{"Outside"}) {
+			t.Errorf("movies = %q, want only the write made outside the transaction", got)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// 游标来自另一组查询条件（过滤条件或组织不同）
+var ErrCursorMismatch = errors.New("cursor was issued for different filters")
+
+// 游标分页的位置：排序方式、当前记录排序字段的值和id。
+// 对客户端不透明，签名后编码为字符串，防止被篡改成任意的查询条件
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"i"`
+	// 该位置来自模糊搜索的结果，翻页时继续使用模糊搜索
+	Fuzzy bool `json:"f,omitempty"`
+	// 签发游标时查询条件的摘要（cursorScope），翻页时的查询条件必须相同
+	Scope string `json:"h,omitempty"`
+}
+
+// 游标的签名密钥，启动时通过SetCursorSecret设置；未设置时使用随机密钥，重启后此前的游标失效
+var cursorKey = func() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+func SetCursorSecret(secret string) {
+	cursorKey = []byte(secret)
+}
+
+func cursorSignature(payload string) string {
+	mac := hmac.New(sha256.New, cursorKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func encodeCursor(c cursor) string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(js)
+	return payload + "." + cursorSignature(payload)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	payload, signature, ok := strings.Cut(s, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(cursorSignature(payload))) {
+		return cursor{}, errInvalidCursor
+	}
+
+	js, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return cursor{}, errInvalidCursor
+	}
+	var c cursor
+	err = json.Unmarshal(js, &c)
+	if err != nil {
+		return cursor{}, errInvalidCursor
+	}
+	return c, nil
+}
+
+// 排序字段的值在游标中统一保存为字符串，作为sql参数时由数据库按列的类型解析
+func cursorValue(v any) string {
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// 查询条件的摘要，条件相同时摘要相同；游标本身已经签名，这里只需要区分不同的条件
+func cursorScope(conditions any) string {
+	js, err := json.Marshal(conditions)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(js)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
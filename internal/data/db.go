@@ -0,0 +1,87 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// 每条查询默认的超时时间，在调用方传入的context之上再加一层超时；
+// 调用方的context被取消（客户端断开、服务关闭）时查询同样会被取消
+var queryTimeout = 3 * time.Second
+
+func SetQueryTimeout(timeout time.Duration) {
+	queryTimeout = timeout
+}
+
+func withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, queryTimeout)
+}
+
+// *sql.DB和*sql.Tx共有的方法，model基于它执行sql，同一套model既可以直接访问数据库，也可以在事务中使用
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// 在事务中执行fn；db本身已经是事务时直接复用，不再开启新的事务
+func withTx(ctx context.Context, db dbtx, fn func(dbtx) error) error {
+	conn, ok := db.(*sql.DB)
+	if !ok {
+		return fn(db)
+	}
+
+	return runTx(ctx, conn, nil, func(tx *sql.Tx) error {
+		return fn(tx)
+	})
+}
+
+// 事务因序列化冲突或死锁失败时最多执行的次数
+const maxTxAttempts = 3
+
+// 开启事务执行fn，fn返回error时回滚，否则提交；
+// 序列化冲突（40001）和死锁（40P01）时整个事务会被重新执行，因此fn可能执行多次，
+// 不能有事务之外的副作用（例如发送邮件）
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := runTxOnce(ctx, db, opts, fn)
+		if err == nil || attempt == maxTxAttempts || !isSerializationFailure(err) {
+			return err
+		}
+
+		// 随机等待一小段时间，错开与之冲突的事务
+		backoff := time.Duration(attempt*attempt)*10*time.Millisecond + time.Duration(rand.Int63n(int64(10*time.Millisecond)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func runTxOnce(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == "40001" || pqErr.Code == "40P01"
+}
@@ -0,0 +1,71 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// 待确认的邮箱修改，新邮箱通过email-change token确认后才会替换users.email
+type EmailChange struct {
+	UserID    int64
+	CreatedAt time.Time
+	NewEmail  string
+}
+
+type EmailChangeModel struct {
+	DB dbtx
+}
+
+func NewEmailChangeModel(db dbtx) EmailChangeModel {
+	return EmailChangeModel{DB: db}
+}
+
+// 每个用户只保留最近一次的修改请求
+func (m EmailChangeModel) Insert(ctx context.Context, change *EmailChange) error {
+	query := `
+		INSERT INTO email_changes (user_id, new_email)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET new_email = EXCLUDED.new_email, created_at = NOW()
+		RETURNING created_at`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, change.UserID, change.NewEmail).Scan(&change.CreatedAt)
+}
+
+func (m EmailChangeModel) Get(ctx context.Context, userID int64) (*EmailChange, error) {
+	query := `
+		SELECT user_id, created_at, new_email
+		FROM email_changes
+		WHERE user_id = $1`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var change EmailChange
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&change.UserID, &change.CreatedAt, &change.NewEmail)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &change, nil
+}
+
+func (m EmailChangeModel) Delete(ctx context.Context, userID int64) error {
+	query := `
+		DELETE FROM email_changes WHERE user_id = $1`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
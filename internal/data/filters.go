@@ -1,6 +1,8 @@
 package data
 
 import (
+	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/embracexyz/greenlight/internal/validator"
@@ -8,19 +10,47 @@ import (
 
 // 定义各种model通用的分页特性
 // 1. 以什么字段排序；2. 允许排序的字段；3排序后从第几页展示多少行
+// 指定After或Before时改为游标分页（keyset），从游标所在的位置向后或向前取一页，不受page的限制
 type Filters struct {
 	Page         int
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	After        string
+	Before       string
+	// 页码分页时不计算总数，省去count(*) over()的开销；Metadata中不再有last_page和total_records
+	SkipCount bool
+	// 游标分页默认不计算总数（每翻一页都要重新统计全部记录），为true时才计算
+	CountCursor bool
+
+	// ValidateFilters解析After或Before得到的游标
+	cursor *cursor
+	// 全文搜索没有结果时改为模糊搜索，记录在游标中，后续翻页沿用
+	fuzzy bool
+	// 查询条件的摘要，由model通过bindScope设置，写入生成的游标
+	scope string
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
+	// 结果来自模糊搜索（没有精确匹配的结果）
+	Fuzzy bool `json:"fuzzy,omitempty"`
+	// 请求的各分面中每个取值的记录数，统计范围是全部符合过滤条件的记录，而不只是当前页
+	Facets map[string][]FacetCount `json:"facets,omitempty"`
+}
+
+// 分面中的一个取值；区间分面（年代、时长）的Min和Max是闭区间的边界，可以直接用作对应的范围过滤条件，0表示不限
+type FacetCount struct {
+	Value string `json:"value"`
+	Min   int32  `json:"min,omitempty"`
+	Max   int32  `json:"max,omitempty"`
+	Count int    `json:"count"`
 }
 
 func caclMetadata(totalRecords, page, pageSize int) Metadata {
@@ -53,14 +83,124 @@ func (f Filters) SortDirection() string {
 	return "ASC"
 }
 
+// 是否计算总数
+func (f Filters) countTotal() bool {
+	if f.cursor != nil {
+		return f.CountCursor
+	}
+	return !f.SkipCount
+}
+
+// 绑定本次查询的条件摘要：生成的游标带上摘要，收到的游标必须来自相同的查询条件，
+// 否则游标的位置在另一组结果中没有意义
+func (f *Filters) bindScope(scope string) error {
+	f.scope = scope
+	if f.cursor != nil && f.cursor.Scope != scope {
+		return ErrCursorMismatch
+	}
+	return nil
+}
+
 func (f Filters) limit() int {
 	return f.PageSize
 }
 
 func (f Filters) offset() int {
+	if f.cursor != nil {
+		return 0
+	}
 	return (f.Page - 1) * f.PageSize // 这里通过提前限制page和pageSize大小可以避免溢出
 }
 
+// 通过Before向前翻页时，按相反的顺序查询，取到结果后再反转回来
+func (f Filters) backward() bool {
+	return f.cursor != nil && f.Before != ""
+}
+
+// 排序子句，排序字段相同时按id升序；向前翻页时整体反转
+func (f Filters) orderBy() string {
+	direction, idDirection := f.SortDirection(), "ASC"
+	if f.backward() {
+		direction, idDirection = reverseDirection(direction), "DESC"
+	}
+	return fmt.Sprintf("%s %s, id %s", f.SortColumn(), direction, idDirection)
+}
+
+func reverseDirection(direction string) string {
+	if direction == "DESC" {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+// 游标条件：排在游标位置之后（向前翻页时为之前）的记录，value和id为游标值的占位符
+func (f Filters) keysetCondition(value, id string) string {
+	op := ">"
+	if (f.SortDirection() == "DESC") != f.backward() {
+		op = "<"
+	}
+	idOp := ">"
+	if f.backward() {
+		idOp = "<"
+	}
+	column := f.SortColumn()
+	return fmt.Sprintf("(%s %s %s or (%s = %s and id %s %s))", column, op, value, column, value, idOp, id)
+}
+
+// rows为按查询顺序取出的最多limit+1条记录，多出的一条只用来判断后面是否还有数据；
+// 返回当前页的记录和分页信息，key返回记录的排序字段值和id，用于生成前后页的游标
+func keysetPage[T any](rows []T, f Filters, totalRecords int, key func(T) (any, int64)) ([]T, Metadata) {
+	hasMore := len(rows) > f.limit()
+	if hasMore {
+		rows = rows[:f.limit()]
+	}
+	if f.backward() {
+		slices.Reverse(rows)
+	}
+
+	var metadata Metadata
+	switch {
+	case f.cursor != nil:
+		metadata = Metadata{PageSize: f.PageSize}
+		if f.countTotal() {
+			metadata.TotalRecords = totalRecords
+		}
+	case f.countTotal():
+		metadata = caclMetadata(totalRecords, f.Page, f.PageSize)
+	case len(rows) > 0:
+		metadata = Metadata{CurrentPage: f.Page, PageSize: f.PageSize, FirstPage: 1}
+	}
+	metadata.Fuzzy = f.fuzzy
+
+	cursorAt := func(row T) string {
+		value, id := key(row)
+		return encodeCursor(cursor{Sort: f.Sort, Value: cursorValue(value), ID: id, Fuzzy: f.fuzzy, Scope: f.scope})
+	}
+	// 游标只表示一个位置，当前页为空时，请求中的游标本身就可以用来翻回去
+	switch {
+	case f.backward():
+		if hasMore {
+			metadata.PrevCursor = cursorAt(rows[0])
+		}
+		if len(rows) > 0 {
+			metadata.NextCursor = cursorAt(rows[len(rows)-1])
+		} else {
+			metadata.NextCursor = f.Before
+		}
+	default:
+		if hasMore {
+			metadata.NextCursor = cursorAt(rows[len(rows)-1])
+		}
+		switch {
+		case len(rows) > 0 && (f.cursor != nil || f.Page > 1):
+			metadata.PrevCursor = cursorAt(rows[0])
+		case f.cursor != nil:
+			metadata.PrevCursor = f.After
+		}
+	}
+	return rows, metadata
+}
+
 // 通用的file检查方法，page和pageSize大小合理，sort在sortsafelist内
 func ValidateFilters(v *validator.Validator, filters *Filters) {
 	v.Check(filters.Page > 0, "page", "must be greater than zero")
@@ -68,4 +208,25 @@ func ValidateFilters(v *validator.Validator, filters *Filters) {
 	v.Check(filters.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(filters.PageSize <= 100, "page_size", "must be a maximum of 100")
 	v.Check(validator.In(filters.Sort, filters.SortSafelist...), "sort", "invalid sort value")
+
+	if filters.After == "" && filters.Before == "" {
+		return
+	}
+	v.Check(filters.After == "" || filters.Before == "", "before", "cannot be used together with after")
+	v.Check(filters.Page == 1, "page", "cannot be used together with after or before")
+
+	key, raw := "after", filters.After
+	if raw == "" {
+		key, raw = "before", filters.Before
+	}
+	c, err := decodeCursor(raw)
+	switch {
+	case err != nil:
+		v.AddFieldError(key, "must be a valid cursor")
+	case c.Sort != filters.Sort:
+		v.AddFieldError(key, "was issued for a different sort")
+	default:
+		filters.cursor = &c
+		filters.fuzzy = c.Fuzzy
+	}
 }
@@ -0,0 +1,1176 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"html"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// 进程内的存储，实现与PostgreSQL版本相同的语义（乐观锁、唯一约束、token过期、级联删除等），
+// 用于本地演示和测试；进程退出后数据即丢失。
+// 各个model通过memoryStore访问共享的memoryDB，事务中的model使用inTx为true的memoryStore
+type memoryStore struct {
+	*memoryDB
+	inTx bool
+}
+
+type memoryDB struct {
+	mu sync.Mutex
+	// 事务串行执行，失败时整体恢复到事务开始前的快照；
+	// 事务之外的读写同样要等待进行中的事务结束，否则恢复快照时会丢掉这些写入
+	txMu   sync.Mutex
+	tables memoryTables
+}
+
+type memoryTables struct {
+	sequences       map[string]int64
+	movies          map[int64]Movie
+	users           map[int64]User
+	tokens          map[string]memoryToken // key为token hash
+	permissions     map[string]int64       // code -> id
+	userPermissions map[userGrant]struct{}
+	roles           map[string]Role
+	userRoles       map[userGrant]struct{}
+	apiKeys         map[int64]APIKey
+	totp            map[int64]TOTP
+	attempts        map[string]Attempts
+	emailChanges    map[int64]EmailChange
+	audit           []AuditEntry
+	organizations   map[int64]Organization
+	memberships     map[membershipKey]Membership
+}
+
+type memoryToken struct {
+	Token
+	used bool
+}
+
+// 授予用户的权限code或角色名
+type userGrant struct {
+	userID int64
+	name   string
+}
+
+type membershipKey struct {
+	orgID  int64
+	userID int64
+}
+
+// 表中存的都是值，写入时整体替换，因此浅拷贝各个map即可得到一份快照
+func (t memoryTables) clone() memoryTables {
+	return memoryTables{
+		sequences:       maps.Clone(t.sequences),
+		movies:          maps.Clone(t.movies),
+		users:           maps.Clone(t.users),
+		tokens:          maps.Clone(t.tokens),
+		permissions:     maps.Clone(t.permissions),
+		userPermissions: maps.Clone(t.userPermissions),
+		roles:           maps.Clone(t.roles),
+		userRoles:       maps.Clone(t.userRoles),
+		apiKeys:         maps.Clone(t.apiKeys),
+		totp:            maps.Clone(t.totp),
+		attempts:        maps.Clone(t.attempts),
+		emailChanges:    maps.Clone(t.emailChanges),
+		audit:           slices.Clone(t.audit),
+		organizations:   maps.Clone(t.organizations),
+		memberships:     maps.Clone(t.memberships),
+	}
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{memoryDB: &memoryDB{
+		tables: memoryTables{
+			sequences:       make(map[string]int64),
+			movies:          make(map[int64]Movie),
+			users:           make(map[int64]User),
+			tokens:          make(map[string]memoryToken),
+			permissions:     make(map[string]int64),
+			userPermissions: make(map[userGrant]struct{}),
+			roles:           make(map[string]Role),
+			userRoles:       make(map[userGrant]struct{}),
+			apiKeys:         make(map[int64]APIKey),
+			totp:            make(map[int64]TOTP),
+			attempts:        make(map[string]Attempts),
+			emailChanges:    make(map[int64]EmailChange),
+			organizations:   make(map[int64]Organization),
+			memberships:     make(map[membershipKey]Membership),
+		},
+	}}
+
+	// 与migrations中初始化的权限和角色保持一致
+	for _, code := range []string{"movies:read", "movies:write", "movies:write:own", "admin:read", "admin:write", "organizations:write"} {
+		s.tables.permissions[code] = s.nextID("permissions")
+	}
+	roles := []Role{
+		{Name: "viewer", Permissions: Permisions{"movies:read"}},
+		{Name: "editor", Permissions: Permisions{"movies:read", "movies:write"}},
+		{Name: "admin", Permissions: Permisions{"admin:read", "admin:write"}},
+		{Name: "owner", Permissions: Permisions{"movies:read", "movies:write", "organizations:write"}},
+	}
+	for _, role := range roles {
+		role.ID = s.nextID("roles")
+		s.tables.roles[role.Name] = role
+	}
+	// 与migrations中的默认组织一致
+	s.tables.organizations[s.nextID("organizations")] = Organization{ID: 1, CreatedAt: memoryNow(), Name: "Default"}
+	return s
+}
+
+// 检查ctx后加锁，ctx已经取消时与数据库查询一样返回错误；事务之外还需要等待进行中的事务结束
+func (s *memoryStore) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !s.inTx {
+		s.txMu.Lock()
+	}
+	s.mu.Lock()
+	return nil
+}
+
+func (s *memoryStore) unlock() {
+	s.mu.Unlock()
+	if !s.inTx {
+		s.txMu.Unlock()
+	}
+}
+
+func (s *memoryStore) nextID(table string) int64 {
+	s.tables.sequences[table]++
+	return s.tables.sequences[table]
+}
+
+// 在事务中执行fn，fn通过tx访问存储；fn返回error时恢复到事务开始前的快照
+func (s *memoryStore) withTx(ctx context.Context, fn func(tx *memoryStore) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	tx := &memoryStore{memoryDB: s.memoryDB, inTx: true}
+	tx.mu.Lock()
+	saved := tx.tables.clone()
+	tx.mu.Unlock()
+
+	err := fn(tx)
+	if err != nil {
+		tx.mu.Lock()
+		tx.tables = saved
+		tx.mu.Unlock()
+	}
+	return err
+}
+
+// 使用进程内存储的Models，事务通过快照实现回滚；事务与事务之外的读写都串行执行，因此只适合测试和本地演示
+func NewMemoryModels() Models {
+	s := newMemoryStore()
+	models := newMemoryModels(s)
+	models.memory = s
+	return models
+}
+
+func newMemoryModels(s *memoryStore) Models {
+	return Models{
+		MovieModel:        memoryMovieModel{s},
+		UserModel:         memoryUserModel{s},
+		TokenModel:        memoryTokenModel{s},
+		PermisionModel:    memoryPermisionModel{s},
+		RoleModel:         memoryRoleModel{s},
+		APIKeyModel:       memoryAPIKeyModel{s},
+		TOTPModel:         memoryTOTPModel{s},
+		AttemptModel:      memoryAttemptModel{s},
+		EmailChangeModel:  memoryEmailChangeModel{s},
+		AuditModel:        memoryAuditModel{s},
+		OrganizationModel: memoryOrganizationModel{s},
+	}
+}
+
+// 与timestamp(0)列一致，只保留到秒
+func memoryNow() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+// 按filters排序并分页，排序字段相同时按id排序（与sql中的order by ..., id一致）；
+// columns返回记录排序字段的值（int64、string或time.Time），游标分页只支持id升序作为次要排序
+func sortAndPage[T any](records []*T, filters Filters, columns map[string]func(*T) any, id func(*T) int64, idDesc bool) ([]*T, Metadata) {
+	value := columns[filters.SortColumn()]
+	desc := filters.SortDirection() == "DESC"
+
+	slices.SortFunc(records, func(a, b *T) int {
+		c := compareValues(value(a), value(b))
+		if desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+		if idDesc {
+			return cmp.Compare(id(b), id(a))
+		}
+		return cmp.Compare(id(a), id(b))
+	})
+	total := len(records)
+
+	var rows []*T
+	switch c := filters.cursor; {
+	case c == nil:
+		start := min(filters.offset(), len(records))
+		rows = records[start:min(start+filters.limit()+1, len(records))]
+	default:
+		// 与keysetCondition一致：排在游标位置之后（向前翻页时为之前）的记录
+		for _, record := range records {
+			pos := compareValues(value(record), parseCursorValue(value(record), c.Value))
+			if desc {
+				pos = -pos
+			}
+			if pos == 0 {
+				pos = cmp.Compare(id(record), c.ID)
+			}
+			if (pos > 0 && !filters.backward()) || (pos < 0 && filters.backward()) {
+				rows = append(rows, record)
+			}
+		}
+		if filters.backward() {
+			slices.Reverse(rows)
+		}
+		rows = rows[:min(filters.limit()+1, len(rows))]
+	}
+
+	page, metadata := keysetPage(slices.Clone(rows), filters, total, func(record *T) (any, int64) {
+		return value(record), id(record)
+	})
+	if page == nil {
+		page = []*T{}
+	}
+	return page, metadata
+}
+
+func compareValues(a, b any) int {
+	switch a := a.(type) {
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case float32:
+		return cmp.Compare(a, b.(float32))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	default:
+		return strings.Compare(a.(string), b.(string))
+	}
+}
+
+// 把游标中的字符串按sample的类型解析，相当于sql中按列的类型解析参数
+func parseCursorValue(sample any, s string) any {
+	switch sample.(type) {
+	case int64:
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return n
+	case float32:
+		f, _ := strconv.ParseFloat(s, 32)
+		return float32(f)
+	case time.Time:
+		t, _ := time.Parse(time.RFC3339Nano, s)
+		return t
+	default:
+		return s
+	}
+}
+
+// 近似to_tsvector('simple', ...)：按非字母数字切分并转为小写
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+type memoryMovieModel struct {
+	s *memoryStore
+}
+
+func (m memoryMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	movie.ID = m.s.nextID("movies")
+	movie.CreatedAt = memoryNow()
+	movie.Version = 1
+	movie.UpdatedBy = movie.CreatedBy
+	stored := *movie
+	stored.Genres = slices.Clone(movie.Genres)
+	m.s.tables.movies[movie.ID] = stored
+	return nil
+}
+
+func (m memoryMovieModel) Delete(ctx context.Context, orgID, id int64) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	movie, ok := m.s.tables.movies[id]
+	if !ok || movie.OrganizationID != orgID {
+		return ErrRecordNotFound
+	}
+	delete(m.s.tables.movies, id)
+	return nil
+}
+
+func (m memoryMovieModel) Update(ctx context.Context, movie *Movie) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	stored, ok := m.s.tables.movies[movie.ID]
+	if !ok || stored.Version != movie.Version || stored.OrganizationID != movie.OrganizationID {
+		return ErrEditConflict
+	}
+
+	stored.Title = movie.Title
+	stored.Year = movie.Year
+	stored.Runtime = movie.Runtime
+	stored.Genres = slices.Clone(movie.Genres)
+	stored.Description = movie.Description
+	stored.Plot = movie.Plot
+	stored.Language = movie.Language
+	stored.UpdatedBy = movie.UpdatedBy
+	stored.Version++
+	m.s.tables.movies[movie.ID] = stored
+	movie.Version = stored.Version
+	return nil
+}
+
+func (m memoryMovieModel) Get(ctx context.Context, orgID, id int64) (*Movie, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	movie, ok := m.s.tables.movies[id]
+	if !ok || movie.OrganizationID != orgID {
+		return nil, ErrRecordNotFound
+	}
+	movie.Genres = slices.Clone(movie.Genres)
+	return &movie, nil
+}
+
+func (m memoryMovieModel) GetAll(ctx context.Context, orgID int64, filter MovieFilter, filters Filters) ([]*Movie, Metadata, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, Metadata{}, err
+	}
+	defer m.s.unlock()
+
+	if err := filters.bindScope(filter.cursorScope(orgID)); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	movies := m.filter(orgID, filter, filters.fuzzy)
+	// 与MovieModel.GetAll一致，全文搜索没有结果时改为模糊搜索
+	if filter.Search != "" && len(movies) == 0 && !filters.fuzzy && filters.cursor == nil && filters.Page == 1 {
+		filters.fuzzy = true
+		movies = m.filter(orgID, filter, true)
+	}
+
+	counts := movieFacetCounts(movies, filter.Facets)
+	page, metadata := sortAndPage(movies, filters, movieSortValues, func(movie *Movie) int64 { return movie.ID }, false)
+	metadata.Facets = movieFacets(filter.Facets, counts)
+	return page, metadata, nil
+}
+
+// 与movieFacetsSQL的聚合结果一致
+func movieFacetCounts(movies []*Movie, facets []string) map[string]map[string]int {
+	counts := make(map[string]map[string]int, len(facets))
+	for _, facet := range facets {
+		counts[facet] = map[string]int{}
+	}
+	for _, movie := range movies {
+		for _, facet := range facets {
+			switch facet {
+			case "genres":
+				for _, genre := range movie.Genres {
+					counts[facet][genre]++
+				}
+			case "decade":
+				counts[facet][strconv.Itoa(int(movie.Year/10*10))]++
+			case "runtime":
+				bucket := 0
+				for _, bound := range runtimeFacetBounds {
+					if int32(movie.Runtime) >= bound {
+						bucket++
+					}
+				}
+				counts[facet][strconv.Itoa(bucket)]++
+			}
+		}
+	}
+	return counts
+}
+
+func (m memoryMovieModel) filter(orgID int64, filter MovieFilter, fuzzy bool) []*Movie {
+	query := searchWords(filter.Title)
+	search := parseWebSearch(filter.Search)
+	movies := []*Movie{}
+	for _, movie := range m.s.tables.movies {
+		if movie.OrganizationID != orgID {
+			continue
+		}
+		if filter.CreatedBy != 0 && movie.CreatedBy != filter.CreatedBy {
+			continue
+		}
+		// 与plainto_tsquery一致，标题需要包含查询中的每一个词
+		words := searchWords(movie.Title)
+		if !allIn(query, words) || !allIn(filter.Genres, movie.Genres) {
+			continue
+		}
+		if !filter.matchRanges(&movie) {
+			continue
+		}
+		if len(filter.GenresAny) > 0 && !slices.ContainsFunc(filter.GenresAny, func(genre string) bool { return slices.Contains(movie.Genres, genre) }) {
+			continue
+		}
+		if slices.ContainsFunc(filter.GenresNone, func(genre string) bool { return slices.Contains(movie.Genres, genre) }) {
+			continue
+		}
+		if len(filter.IDs) > 0 && !slices.Contains(filter.IDs, movie.ID) {
+			continue
+		}
+		switch {
+		case filter.Search != "" && fuzzy:
+			similarity := wordSimilarity(filter.Search, movie.Title)
+			if similarity < wordSimilarityThreshold {
+				continue
+			}
+			movie.relevance = -similarity
+		case filter.Search != "":
+			fields := movieSearchFields(&movie)
+			if !search.match(fields) {
+				continue
+			}
+			movie.relevance = -search.rank(fields)
+			movie.Headline = search.headline(strings.Join([]string{movie.Title, movie.Description, movie.Plot}, " "))
+		}
+		movie.Genres = slices.Clone(movie.Genres)
+		movies = append(movies, &movie)
+	}
+	return movies
+}
+
+// 与MovieFilter.where中的范围条件一致
+func (filter MovieFilter) matchRanges(movie *Movie) bool {
+	return (filter.YearMin == 0 || movie.Year >= filter.YearMin) &&
+		(filter.YearMax == 0 || movie.Year <= filter.YearMax) &&
+		(filter.RuntimeMin == 0 || movie.Runtime >= filter.RuntimeMin) &&
+		(filter.RuntimeMax == 0 || movie.Runtime <= filter.RuntimeMax) &&
+		(filter.CreatedAfter.IsZero() || movie.CreatedAt.After(filter.CreatedAfter)) &&
+		(filter.CreatedBefore.IsZero() || movie.CreatedAt.Before(filter.CreatedBefore))
+}
+
+func (m memoryMovieModel) Suggest(ctx context.Context, orgID int64, q string, limit int) ([]*Suggestion, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	type candidate struct {
+		Suggestion
+		prefix     bool
+		similarity float32
+	}
+	candidates := []candidate{}
+	for _, movie := range m.s.tables.movies {
+		if movie.OrganizationID != orgID {
+			continue
+		}
+		c := candidate{
+			Suggestion: Suggestion{ID: movie.ID, Title: movie.Title},
+			prefix:     strings.HasPrefix(strings.ToLower(movie.Title), strings.ToLower(q)),
+			similarity: wordSimilarity(q, movie.Title),
+		}
+		if c.prefix || c.similarity >= wordSimilarityThreshold {
+			candidates = append(candidates, c)
+		}
+	}
+
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		switch {
+		case a.prefix != b.prefix:
+			if a.prefix {
+				return -1
+			}
+			return 1
+		case a.similarity != b.similarity:
+			return cmp.Compare(b.similarity, a.similarity)
+		case a.Title != b.Title:
+			return strings.Compare(a.Title, b.Title)
+		default:
+			return cmp.Compare(a.ID, b.ID)
+		}
+	})
+
+	suggestions := []*Suggestion{}
+	for _, c := range candidates[:min(limit, len(candidates))] {
+		suggestions = append(suggestions, &c.Suggestion)
+	}
+	return suggestions, nil
+}
+
+// 全文搜索的近似实现：不做词干提取，相关度按匹配字段的权重累加（与ts_rank默认的权重一致）
+type webSearch [][]searchTerm // 以or分隔的若干组条件，每组内的条件都需要满足
+
+type searchTerm struct {
+	words  []string // 多个词时为短语，需要连续出现
+	negate bool
+}
+
+// 标题、类型、简介、剧情，对应search_vector中的权重A、B、C、D
+var searchWeights = []float32{1.0, 0.4, 0.2, 0.1}
+
+func movieSearchFields(movie *Movie) [][]string {
+	return [][]string{
+		searchWords(movie.Title),
+		searchWords(strings.Join(movie.Genres, " ")),
+		searchWords(movie.Description),
+		searchWords(movie.Plot),
+	}
+}
+
+// 按websearch_to_tsquery的语法解析："短语"、or、-排除
+func parseWebSearch(q string) webSearch {
+	search := webSearch{nil}
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		negate := strings.HasPrefix(q, "-")
+		q = strings.TrimPrefix(q, "-")
+
+		var token string
+		if rest, ok := strings.CutPrefix(q, `"`); ok {
+			token, q, _ = strings.Cut(rest, `"`)
+		} else if i := strings.IndexFunc(q, unicode.IsSpace); i >= 0 {
+			token, q = q[:i], q[i:]
+		} else {
+			token, q = q, ""
+		}
+
+		if !negate && strings.EqualFold(token, "or") {
+			search = append(search, nil)
+			continue
+		}
+		if words := searchWords(token); len(words) > 0 {
+			search[len(search)-1] = append(search[len(search)-1], searchTerm{words: words, negate: negate})
+		}
+	}
+	return search
+}
+
+func (s webSearch) match(fields [][]string) bool {
+	for _, group := range s {
+		if len(group) == 0 {
+			continue
+		}
+		matched := true
+		for _, term := range group {
+			if term.found(fields) == term.negate {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (s webSearch) rank(fields [][]string) float32 {
+	var rank float32
+	for _, group := range s {
+		for _, term := range group {
+			for i, field := range fields {
+				if !term.negate && containsPhrase(field, term.words) {
+					rank += searchWeights[i]
+				}
+			}
+		}
+	}
+	return rank
+}
+
+// 与ts_headline类似，从第一个匹配的词附近截取一段，文本做HTML转义后，匹配的词用<b></b>标出
+func (s webSearch) headline(text string) string {
+	highlight := make(map[string]bool)
+	for _, group := range s {
+		for _, term := range group {
+			for _, word := range term.words {
+				highlight[word] = !term.negate
+			}
+		}
+	}
+
+	tokens := strings.Fields(text)
+	start := slices.IndexFunc(tokens, func(token string) bool {
+		return slices.ContainsFunc(searchWords(token), func(word string) bool { return highlight[word] })
+	})
+	start = max(start-5, 0)
+	tokens = slices.Clone(tokens[start:min(start+20, len(tokens))])
+	for i, token := range tokens {
+		tokens[i] = html.EscapeString(token)
+		if slices.ContainsFunc(searchWords(token), func(word string) bool { return highlight[word] }) {
+			tokens[i] = "<b>" + tokens[i] + "</b>"
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+func (t searchTerm) found(fields [][]string) bool {
+	return slices.ContainsFunc(fields, func(field []string) bool { return containsPhrase(field, t.words) })
+}
+
+func containsPhrase(words, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		if slices.Equal(words[i:i+len(phrase)], phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// 与pg_trgm的pg_trgm.word_similarity_threshold默认值一致
+const wordSimilarityThreshold = 0.6
+
+// 近似pg_trgm的word_similarity：q的三元组中有多少出现在text中
+func wordSimilarity(q, text string) float32 {
+	query := trigrams(q)
+	if len(query) == 0 {
+		return 0
+	}
+	words := trigrams(text)
+	common := 0
+	for trigram := range query {
+		if _, ok := words[trigram]; ok {
+			common++
+		}
+	}
+	return float32(common) / float32(len(query))
+}
+
+// 与pg_trgm一致，每个词转为小写并在前面补两个空格、后面补一个空格后取三元组
+func trigrams(s string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, word := range searchWords(s) {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = struct{}{}
+		}
+	}
+	return set
+}
+
+// values中的每一个元素都在set中
+func allIn(values, set []string) bool {
+	for _, value := range values {
+		if !slices.Contains(set, value) {
+			return false
+		}
+	}
+	return true
+}
+
+type memoryUserModel struct {
+	s *memoryStore
+}
+
+// users.email为citext，唯一约束不区分大小写
+func (m memoryUserModel) emailTaken(email string, exceptID int64) bool {
+	for _, user := range m.s.tables.users {
+		if user.ID != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回副本，与从数据库读出的user一样不带明文密码
+func storedUser(user User) User {
+	user.Password.plaintext = nil
+	user.Permissions = nil
+	user.OrganizationID = 0
+	return user
+}
+
+func (m memoryUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	user, ok := m.s.tables.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+func (m memoryUserModel) Insert(ctx context.Context, user *User) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	if m.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+
+	user.ID = m.s.nextID("users")
+	user.CreatedAt = memoryNow()
+	user.Version = 1
+	user.TokenGeneration = 0
+	m.s.tables.users[user.ID] = storedUser(*user)
+	return nil
+}
+
+func (m memoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	for _, user := range m.s.tables.users {
+		if strings.EqualFold(user.Email, email) {
+			return &user, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryUserModel) Update(ctx context.Context, user *User) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	stored, ok := m.s.tables.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+	if m.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+
+	stored.Name = user.Name
+	stored.Email = user.Email
+	stored.Password.hash = user.Password.hash
+	stored.Activated = user.Activated
+	stored.Version++
+	m.s.tables.users[user.ID] = stored
+	user.Version = stored.Version
+	return nil
+}
+
+func (m memoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	token, ok := m.s.tables.tokens[string(hash[:])]
+	if !ok || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	user, ok := m.s.tables.users[token.UserID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+func (m memoryUserModel) RevokeTokens(ctx context.Context, id int64) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	user, ok := m.s.tables.users[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	user.TokenGeneration++
+	m.s.tables.users[id] = user
+	return nil
+}
+
+// 与外键的on delete cascade / set null一致，删除用户的同时清理其关联数据
+func (m memoryUserModel) Delete(ctx context.Context, id int64) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	t := &m.s.tables
+	if _, ok := t.users[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(t.users, id)
+
+	maps.DeleteFunc(t.tokens, func(_ string, token memoryToken) bool { return token.UserID == id })
+	maps.DeleteFunc(t.userPermissions, func(grant userGrant, _ struct{}) bool { return grant.userID == id })
+	maps.DeleteFunc(t.userRoles, func(grant userGrant, _ struct{}) bool { return grant.userID == id })
+	maps.DeleteFunc(t.apiKeys, func(_ int64, key APIKey) bool { return key.UserID == id })
+	maps.DeleteFunc(t.memberships, func(key membershipKey, _ Membership) bool { return key.userID == id })
+	delete(t.totp, id)
+	delete(t.emailChanges, id)
+
+	for movieID, movie := range t.movies {
+		if movie.CreatedBy == id || movie.UpdatedBy == id {
+			if movie.CreatedBy == id {
+				movie.CreatedBy = 0
+			}
+			if movie.UpdatedBy == id {
+				movie.UpdatedBy = 0
+			}
+			t.movies[movieID] = movie
+		}
+	}
+	return nil
+}
+
+func (m memoryUserModel) GetAll(ctx context.Context, email string, filters Filters) ([]*User, Metadata, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, Metadata{}, err
+	}
+	defer m.s.unlock()
+
+	users := []*User{}
+	for _, user := range m.s.tables.users {
+		if strings.Contains(strings.ToLower(user.Email), strings.ToLower(email)) {
+			users = append(users, &user)
+		}
+	}
+
+	page, metadata := sortAndPage(users, filters, map[string]func(*User) any{
+		"id":         func(user *User) any { return user.ID },
+		"name":       func(user *User) any { return user.Name },
+		"email":      func(user *User) any { return strings.ToLower(user.Email) },
+		"created_at": func(user *User) any { return user.CreatedAt },
+	}, func(user *User) int64 { return user.ID }, false)
+	return page, metadata, nil
+}
+
+type memoryTokenModel struct {
+	s *memoryStore
+}
+
+func (m memoryTokenModel) insert(token *Token) {
+	stored := *token
+	stored.Plaintext = ""
+	m.s.tables.tokens[string(token.Hash)] = memoryToken{Token: stored}
+}
+
+func (m memoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	m.insert(token)
+	return nil
+}
+
+func (m memoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (m memoryTokenModel) NewRefresh(ctx context.Context, userID int64, ttl time.Duration, family string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	if family == "" {
+		family, err = newTokenFamily()
+		if err != nil {
+			return nil, err
+		}
+	}
+	token.Family = family
+
+	err = m.Insert(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (m memoryTokenModel) ConsumeRefresh(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	stored, ok := m.s.tables.tokens[string(hash[:])]
+	if !ok || stored.Scope != ScopeRefresh || !stored.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	used := stored.used
+	stored.used = true
+	m.s.tables.tokens[string(hash[:])] = stored
+
+	token := stored.Token
+	token.Plaintext = tokenPlaintext
+	if used {
+		return &token, ErrTokenReused
+	}
+	return &token, nil
+}
+
+func (m memoryTokenModel) DeleteFamily(ctx context.Context, family string) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	maps.DeleteFunc(m.s.tables.tokens, func(_ string, token memoryToken) bool {
+		return token.Scope == ScopeRefresh && token.Family == family
+	})
+	return nil
+}
+
+func (m memoryTokenModel) Consume(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	token, ok := m.s.tables.tokens[string(hash[:])]
+	if !ok || token.Scope != scope || token.UserID != userID || !token.Expiry.After(time.Now()) {
+		return ErrRecordNotFound
+	}
+	delete(m.s.tables.tokens, string(hash[:]))
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	maps.DeleteFunc(m.s.tables.tokens, func(_ string, token memoryToken) bool {
+		return token.Scope == scope && token.UserID == userID
+	})
+	return nil
+}
+
+func (m memoryTokenModel) GetAllForUser(ctx context.Context, userID int64) ([]*Token, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	tokens := []*Token{}
+	for _, stored := range m.s.tables.tokens {
+		if stored.UserID == userID {
+			tokens = append(tokens, &Token{UserID: stored.UserID, Expiry: stored.Expiry, Scope: stored.Scope})
+		}
+	}
+	slices.SortFunc(tokens, func(a, b *Token) int { return a.Expiry.Compare(b.Expiry) })
+	return tokens, nil
+}
+
+type memoryPermisionModel struct {
+	s *memoryStore
+}
+
+// 与queryCodes一致，没有权限时返回nil
+func sortedCodes(set map[string]struct{}) Permisions {
+	var permissions Permisions
+	for code := range set {
+		permissions = append(permissions, code)
+	}
+	slices.Sort(permissions)
+	return permissions
+}
+
+func (m memoryPermisionModel) GetAllForUser(ctx context.Context, userID int64) (Permisions, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	codes := make(map[string]struct{})
+	for grant := range m.s.tables.userPermissions {
+		if grant.userID == userID {
+			codes[grant.name] = struct{}{}
+		}
+	}
+	for grant := range m.s.tables.userRoles {
+		if grant.userID == userID {
+			for _, code := range m.s.tables.roles[grant.name].Permissions {
+				codes[code] = struct{}{}
+			}
+		}
+	}
+	return sortedCodes(codes), nil
+}
+
+func (m memoryPermisionModel) GetDirectForUser(ctx context.Context, userID int64) (Permisions, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	codes := make(map[string]struct{})
+	for grant := range m.s.tables.userPermissions {
+		if grant.userID == userID {
+			codes[grant.name] = struct{}{}
+		}
+	}
+	return sortedCodes(codes), nil
+}
+
+func (m memoryPermisionModel) GetAll(ctx context.Context) (Permisions, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	codes := make(map[string]struct{})
+	for code := range m.s.tables.permissions {
+		codes[code] = struct{}{}
+	}
+	return sortedCodes(codes), nil
+}
+
+func (m memoryPermisionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	codes = uniqueCodes(codes)
+	found := make(map[string]struct{})
+	for _, code := range codes {
+		if _, ok := m.s.tables.permissions[code]; ok {
+			found[code] = struct{}{}
+		}
+	}
+	if len(found) != len(codes) {
+		return ErrRecordNotFound
+	}
+
+	for code := range found {
+		m.s.tables.userPermissions[userGrant{userID, code}] = struct{}{}
+	}
+	return nil
+}
+
+func (m memoryPermisionModel) RemoveForUser(ctx context.Context, userID int64, code string) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	grant := userGrant{userID, code}
+	if _, ok := m.s.tables.userPermissions[grant]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.tables.userPermissions, grant)
+	return nil
+}
+
+func (m memoryPermisionModel) Insert(ctx context.Context, code string) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	if _, ok := m.s.tables.permissions[code]; ok {
+		return ErrDuplicatePermission
+	}
+	m.s.tables.permissions[code] = m.s.nextID("permissions")
+	return nil
+}
+
+type memoryRoleModel struct {
+	s *memoryStore
+}
+
+func (m memoryRoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	roles := []*Role{}
+	for _, role := range m.s.tables.roles {
+		role.Permissions = slices.Clone(role.Permissions)
+		roles = append(roles, &role)
+	}
+	slices.SortFunc(roles, func(a, b *Role) int { return cmp.Compare(a.ID, b.ID) })
+	return roles, nil
+}
+
+func (m memoryRoleModel) GetAllForUser(ctx context.Context, userID int64) ([]string, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	roles := []string{}
+	for grant := range m.s.tables.userRoles {
+		if grant.userID == userID {
+			roles = append(roles, grant.name)
+		}
+	}
+	slices.Sort(roles)
+	return roles, nil
+}
+
+func (m memoryRoleModel) AddForUser(ctx context.Context, userID int64, name string) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	if _, ok := m.s.tables.roles[name]; !ok {
+		return ErrRecordNotFound
+	}
+	m.s.tables.userRoles[userGrant{userID, name}] = struct{}{}
+	return nil
+}
+
+func (m memoryRoleModel) RemoveForUser(ctx context.Context, userID int64, name string) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	grant := userGrant{userID, name}
+	if _, ok := m.s.tables.userRoles[grant]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.tables.userRoles, grant)
+	return nil
+}
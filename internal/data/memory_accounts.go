@@ -0,0 +1,465 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// 账户相关（api key、两步验证、登录尝试、邮箱修改、审计、组织）的内存实现，store见memory.go
+
+type memoryAPIKeyModel struct {
+	s *memoryStore
+}
+
+func (m memoryAPIKeyModel) New(ctx context.Context, userID int64, name string) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	if _, ok := m.s.tables.users[userID]; !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	key.ID = m.s.nextID("api_keys")
+	key.CreatedAt = memoryNow()
+	stored := *key
+	stored.Plaintext = ""
+	m.s.tables.apiKeys[key.ID] = stored
+	return key, nil
+}
+
+func (m memoryAPIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	keys := []*APIKey{}
+	for _, key := range m.s.tables.apiKeys {
+		if key.UserID == userID {
+			key.Hash = nil
+			keys = append(keys, &key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b *APIKey) int { return cmp.Compare(a.ID, b.ID) })
+	return keys, nil
+}
+
+func (m memoryAPIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	key, ok := m.s.tables.apiKeys[id]
+	if !ok || key.UserID != userID {
+		return ErrRecordNotFound
+	}
+	delete(m.s.tables.apiKeys, id)
+	return nil
+}
+
+func (m memoryAPIKeyModel) GetUserForKey(ctx context.Context, plaintext string) (*User, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	hash := sha256.Sum256([]byte(plaintext))
+	for id, key := range m.s.tables.apiKeys {
+		if string(key.Hash) != string(hash[:]) {
+			continue
+		}
+		user, ok := m.s.tables.users[key.UserID]
+		if !ok {
+			return nil, ErrRecordNotFound
+		}
+		now := memoryNow()
+		key.LastUsedAt = &now
+		m.s.tables.apiKeys[id] = key
+		return &user, nil
+	}
+	return nil, ErrRecordNotFound
+}
+
+type memoryTOTPModel struct {
+	s *memoryStore
+}
+
+func (m memoryTOTPModel) Insert(ctx context.Context, totp *TOTP) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	if stored, ok := m.s.tables.totp[totp.UserID]; ok && stored.Confirmed {
+		return ErrEditConflict
+	}
+	if _, ok := m.s.tables.users[totp.UserID]; !ok {
+		return ErrRecordNotFound
+	}
+
+	totp.CreatedAt = memoryNow()
+	totp.Confirmed = false
+	totp.LastStep = 0
+	m.s.tables.totp[totp.UserID] = *totp
+	return nil
+}
+
+func (m memoryTOTPModel) Get(ctx context.Context, userID int64) (*TOTP, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	totp, ok := m.s.tables.totp[userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return &totp, nil
+}
+
+func (m memoryTOTPModel) Use(ctx context.Context, userID, step int64) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	totp, ok := m.s.tables.totp[userID]
+	if !ok || totp.LastStep >= step {
+		return ErrEditConflict
+	}
+	totp.LastStep = step
+	totp.Confirmed = true
+	m.s.tables.totp[userID] = totp
+	return nil
+}
+
+func (m memoryTOTPModel) Delete(ctx context.Context, userID int64) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	if _, ok := m.s.tables.totp[userID]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.tables.totp, userID)
+	return nil
+}
+
+type memoryAttemptModel struct {
+	s *memoryStore
+}
+
+func (m memoryAttemptModel) Get(ctx context.Context, key string) (*Attempts, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	attempts, ok := m.s.tables.attempts[key]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return &attempts, nil
+}
+
+// 与PostgreSQL一样，计数和锁定时间在同一次加锁中写入
+func (m memoryAttemptModel) RecordFailure(ctx context.Context, key string, policy LockoutPolicy) (*Attempts, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	now := time.Now()
+	attempts, ok := m.s.tables.attempts[key]
+	if !ok || attempts.LastFailureAt.Before(now.Add(-policy.Window)) {
+		attempts = Attempts{Key: key}
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = now
+	attempts.LockedUntil = policy.lockedUntil(attempts.Failures, now)
+	m.s.tables.attempts[key] = attempts
+	return &attempts, nil
+}
+
+func (m memoryAttemptModel) RecordSend(ctx context.Context, key string, limit SendLimit) (*Attempts, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	now := time.Now()
+	attempts, ok := m.s.tables.attempts[key]
+	if !ok {
+		attempts = Attempts{Key: key, LockedUntil: now}
+	}
+	if !ok || attempts.LastFailureAt.Before(now.Add(-limit.Window)) {
+		attempts.Failures = 0
+		attempts.LastFailureAt = now
+	}
+	attempts.Failures++
+	m.s.tables.attempts[key] = attempts
+	return &attempts, nil
+}
+
+func (m memoryAttemptModel) Clear(ctx context.Context, key string) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	delete(m.s.tables.attempts, key)
+	return nil
+}
+
+type memoryEmailChangeModel struct {
+	s *memoryStore
+}
+
+func (m memoryEmailChangeModel) Insert(ctx context.Context, change *EmailChange) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	if _, ok := m.s.tables.users[change.UserID]; !ok {
+		return ErrRecordNotFound
+	}
+	change.CreatedAt = memoryNow()
+	m.s.tables.emailChanges[change.UserID] = *change
+	return nil
+}
+
+func (m memoryEmailChangeModel) Get(ctx context.Context, userID int64) (*EmailChange, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	change, ok := m.s.tables.emailChanges[userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return &change, nil
+}
+
+func (m memoryEmailChangeModel) Delete(ctx context.Context, userID int64) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	delete(m.s.tables.emailChanges, userID)
+	return nil
+}
+
+type memoryAuditModel struct {
+	s *memoryStore
+}
+
+// 与数据库一样保存json快照，读出时为json.RawMessage
+func rawSnapshot(v interface{}) (interface{}, error) {
+	b, err := snapshot(v)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	return json.RawMessage(b), nil
+}
+
+func (m memoryAuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	before, err := rawSnapshot(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := rawSnapshot(entry.After)
+	if err != nil {
+		return err
+	}
+
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	entry.ID = m.s.nextID("audit_log")
+	entry.CreatedAt = time.Now()
+	stored := *entry
+	stored.Before = before
+	stored.After = after
+	m.s.tables.audit = append(m.s.tables.audit, stored)
+	return nil
+}
+
+func (m memoryAuditModel) GetAll(ctx context.Context, filter AuditFilter, filters Filters) ([]*AuditEntry, Metadata, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, Metadata{}, err
+	}
+	defer m.s.unlock()
+
+	entries := []*AuditEntry{}
+	for _, entry := range m.s.tables.audit {
+		if (filter.ActorID != 0 && entry.ActorID != filter.ActorID) ||
+			(filter.ResourceType != "" && entry.ResourceType != filter.ResourceType) ||
+			(filter.ResourceID != "" && entry.ResourceID != filter.ResourceID) ||
+			(filter.Action != "" && entry.Action != filter.Action) ||
+			(!filter.From.IsZero() && entry.CreatedAt.Before(filter.From)) ||
+			(!filter.To.IsZero() && !entry.CreatedAt.Before(filter.To)) {
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+
+	page, metadata := sortAndPage(entries, filters, map[string]func(*AuditEntry) any{
+		"id":         func(entry *AuditEntry) any { return entry.ID },
+		"created_at": func(entry *AuditEntry) any { return entry.CreatedAt },
+	}, func(entry *AuditEntry) int64 { return entry.ID }, true)
+	return page, metadata, nil
+}
+
+func (m memoryAuditModel) GetAllForUser(ctx context.Context, userID int64) ([]*AuditEntry, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	// 审计记录按写入顺序保存，即按created_at, id排序
+	entries := []*AuditEntry{}
+	for _, entry := range m.s.tables.audit {
+		if entry.ActorID == userID || (entry.ResourceType == "user" && entry.ResourceID == strconv.FormatInt(userID, 10)) {
+			entries = append(entries, &entry)
+		}
+	}
+	return entries, nil
+}
+
+type memoryOrganizationModel struct {
+	s *memoryStore
+}
+
+func (m memoryOrganizationModel) Insert(ctx context.Context, org *Organization, ownerID int64) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	if _, ok := m.s.tables.users[ownerID]; !ok {
+		return ErrRecordNotFound
+	}
+
+	org.ID = m.s.nextID("organizations")
+	org.CreatedAt = memoryNow()
+	org.Role = ""
+	m.s.tables.organizations[org.ID] = *org
+	m.s.tables.memberships[membershipKey{org.ID, ownerID}] = Membership{
+		OrganizationID: org.ID,
+		UserID:         ownerID,
+		Role:           "owner",
+		CreatedAt:      org.CreatedAt,
+	}
+	org.Role = "owner"
+	return nil
+}
+
+func (m memoryOrganizationModel) GetAllForUser(ctx context.Context, userID int64) ([]*Organization, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	orgs := []*Organization{}
+	for key, membership := range m.s.tables.memberships {
+		if key.userID != userID {
+			continue
+		}
+		org := m.s.tables.organizations[key.orgID]
+		org.Role = membership.Role
+		orgs = append(orgs, &org)
+	}
+	slices.SortFunc(orgs, func(a, b *Organization) int { return cmp.Compare(a.ID, b.ID) })
+	return orgs, nil
+}
+
+func (m memoryOrganizationModel) GetMembership(ctx context.Context, orgID, userID int64) (*Membership, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	membership, ok := m.s.tables.memberships[membershipKey{orgID, userID}]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	membership.Permissions = Permisions{}
+	for _, code := range m.s.tables.roles[membership.Role].Permissions {
+		membership.Permissions = append(membership.Permissions, code)
+	}
+	slices.Sort(membership.Permissions)
+	return &membership, nil
+}
+
+func (m memoryOrganizationModel) GetMembers(ctx context.Context, orgID int64) ([]*Membership, error) {
+	if err := m.s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.s.unlock()
+
+	members := []*Membership{}
+	for key, membership := range m.s.tables.memberships {
+		if key.orgID == orgID {
+			members = append(members, &membership)
+		}
+	}
+	slices.SortFunc(members, func(a, b *Membership) int { return cmp.Compare(a.UserID, b.UserID) })
+	return members, nil
+}
+
+func (m memoryOrganizationModel) SetMember(ctx context.Context, membership *Membership) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	_, userFound := m.s.tables.users[membership.UserID]
+	_, orgFound := m.s.tables.organizations[membership.OrganizationID]
+	_, roleFound := m.s.tables.roles[membership.Role]
+	if !userFound || !orgFound || !roleFound {
+		return ErrRecordNotFound
+	}
+
+	key := membershipKey{membership.OrganizationID, membership.UserID}
+	stored, ok := m.s.tables.memberships[key]
+	if !ok {
+		stored = Membership{OrganizationID: key.orgID, UserID: key.userID, CreatedAt: memoryNow()}
+	}
+	stored.Role = membership.Role
+	m.s.tables.memberships[key] = stored
+	membership.CreatedAt = stored.CreatedAt
+	return nil
+}
+
+func (m memoryOrganizationModel) RemoveMember(ctx context.Context, orgID, userID int64) error {
+	if err := m.s.lock(ctx); err != nil {
+		return err
+	}
+	defer m.s.unlock()
+
+	key := membershipKey{orgID, userID}
+	if _, ok := m.s.tables.memberships[key]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.tables.memberships, key)
+	return nil
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
@@ -13,36 +14,187 @@ var (
 
 // 包含所有model，作为统一的引用入口
 type Models struct {
-	MovieModel interface {
-		Insert(*Movie) error
-		Delete(int64) error
-		Update(*Movie) error
-		Get(int64) (*Movie, error)
-		GetAll(string, []string, Filters) ([]*Movie, Metadata, error)
-	}
-	UserModel interface {
-		Get(int64) (*User, error)
-		Insert(*User) error
-		GetByEmail(string) (*User, error)
-		Update(*User) error
-		GetForToken(string, string) (*User, error)
-	}
-	TokenModel interface {
-		New(int64, time.Duration, string) (*Token, error)
-		Insert(*Token) error
-		DeleteAllForUser(string, int64) error
-	}
-	PermisionModel interface {
-		GetAllForUser(int64) (Permisions, error)
-		AddForUser(int64, ...string) error
-	}
+	MovieModel        movieStore
+	UserModel         userStore
+	TokenModel        tokenStore
+	PermisionModel    permissionStore
+	RoleModel         roleStore
+	APIKeyModel       apiKeyStore
+	TOTPModel         totpStore
+	AttemptModel      attemptStore
+	EmailChangeModel  emailChangeStore
+	AuditModel        auditStore
+	OrganizationModel organizationStore
+
+	// 非事务的Models持有连接池，用于开启事务；事务中的Models为nil
+	db *sql.DB
+	// 事务中的Models需要套上与外层相同的包装（例如缓存）
+	wrap func(Models) Models
+	// NewMemoryModels创建的Models使用进程内存储，事务通过快照实现；事务中的Models为nil
+	memory *memoryStore
+	// 事务中的Models登记的回调（例如使缓存失效），在事务提交后执行；非事务的Models为nil
+	afterCommit *[]func()
+}
+
+// 各model对外提供的方法，handler只依赖这些接口，具体实现可以替换或包装（例如加一层缓存）
+// 电影属于某个组织，除Insert外都需要传入组织id，只能访问该组织的电影
+type movieStore interface {
+	Insert(context.Context, *Movie) error
+	Delete(context.Context, int64, int64) error
+	Update(context.Context, *Movie) error
+	Get(context.Context, int64, int64) (*Movie, error)
+	GetAll(context.Context, int64, MovieFilter, Filters) ([]*Movie, Metadata, error)
+	Suggest(context.Context, int64, string, int) ([]*Suggestion, error)
+}
+
+type userStore interface {
+	Get(context.Context, int64) (*User, error)
+	Insert(context.Context, *User) error
+	GetByEmail(context.Context, string) (*User, error)
+	Update(context.Context, *User) error
+	GetForToken(context.Context, string, string) (*User, error)
+	RevokeTokens(context.Context, int64) error
+	Delete(context.Context, int64) error
+	GetAll(context.Context, string, Filters) ([]*User, Metadata, error)
+}
+
+type tokenStore interface {
+	New(context.Context, int64, time.Duration, string) (*Token, error)
+	Insert(context.Context, *Token) error
+	DeleteAllForUser(context.Context, string, int64) error
+	NewRefresh(context.Context, int64, time.Duration, string) (*Token, error)
+	ConsumeRefresh(context.Context, string) (*Token, error)
+	DeleteFamily(context.Context, string) error
+	Consume(context.Context, string, int64, string) error
+	GetAllForUser(context.Context, int64) ([]*Token, error)
+}
+
+type permissionStore interface {
+	GetAllForUser(context.Context, int64) (Permisions, error)
+	GetDirectForUser(context.Context, int64) (Permisions, error)
+	GetAll(context.Context) (Permisions, error)
+	AddForUser(context.Context, int64, ...string) error
+	RemoveForUser(context.Context, int64, string) error
+	Insert(context.Context, string) error
+}
+
+type roleStore interface {
+	GetAll(context.Context) ([]*Role, error)
+	GetAllForUser(context.Context, int64) ([]string, error)
+	AddForUser(context.Context, int64, string) error
+	RemoveForUser(context.Context, int64, string) error
+}
+
+type apiKeyStore interface {
+	New(context.Context, int64, string) (*APIKey, error)
+	GetAllForUser(context.Context, int64) ([]*APIKey, error)
+	Delete(context.Context, int64, int64) error
+	GetUserForKey(context.Context, string) (*User, error)
+}
+
+type totpStore interface {
+	Insert(context.Context, *TOTP) error
+	Get(context.Context, int64) (*TOTP, error)
+	Use(context.Context, int64, int64) error
+	Delete(context.Context, int64) error
+}
+
+type attemptStore interface {
+	Get(context.Context, string) (*Attempts, error)
+	RecordFailure(context.Context, string, LockoutPolicy) (*Attempts, error)
+	RecordSend(context.Context, string, SendLimit) (*Attempts, error)
+	Clear(context.Context, string) error
+}
+
+type emailChangeStore interface {
+	Insert(context.Context, *EmailChange) error
+	Get(context.Context, int64) (*EmailChange, error)
+	Delete(context.Context, int64) error
+}
+
+type auditStore interface {
+	Insert(context.Context, *AuditEntry) error
+	GetAll(context.Context, AuditFilter, Filters) ([]*AuditEntry, Metadata, error)
+	GetAllForUser(context.Context, int64) ([]*AuditEntry, error)
+}
+
+type organizationStore interface {
+	Insert(context.Context, *Organization, int64) error
+	GetAllForUser(context.Context, int64) ([]*Organization, error)
+	GetMembership(context.Context, int64, int64) (*Membership, error)
+	GetMembers(context.Context, int64) ([]*Membership, error)
+	SetMember(context.Context, *Membership) error
+	RemoveMember(context.Context, int64, int64) error
 }
 
 func NewModels(db *sql.DB) Models {
+	models := newModels(db)
+	models.db = db
+	return models
+}
+
+func newModels(db dbtx) Models {
 	return Models{
-		MovieModel:     NewMovieModel(db),
-		UserModel:      NewUserModel(db),
-		TokenModel:     NewTokenModel(db),
-		PermisionModel: NewPermisionModel(db),
+		MovieModel:        NewMovieModel(db),
+		UserModel:         NewUserModel(db),
+		TokenModel:        NewTokenModel(db),
+		PermisionModel:    NewPermisionModel(db),
+		RoleModel:         NewRoleModel(db),
+		APIKeyModel:       NewAPIKeyModel(db),
+		TOTPModel:         NewTOTPModel(db),
+		AttemptModel:      NewAttemptModel(db),
+		EmailChangeModel:  NewEmailChangeModel(db),
+		AuditModel:        NewAuditModel(db),
+		OrganizationModel: NewOrganizationModel(db),
+	}
+}
+
+// 在同一个事务中执行fn，fn通过参数中的Models访问数据库，返回error时回滚；
+// 已经处于事务中时直接复用外层事务。序列化冲突或死锁时事务会自动重试，
+// 因此fn可能执行多次，不能有事务之外的副作用；fn修改了外部的值时（例如Update写回调用方结构体的版本号），
+// 需要在fn开头恢复，否则下一次尝试会带着上一次的结果执行
+func (m Models) WithTx(ctx context.Context, fn func(Models) error) error {
+	return m.WithTxOptions(ctx, nil, fn)
+}
+
+// 与WithTx相同，可以指定隔离级别等选项，例如先读后写、需要避免write skew时使用sql.LevelSerializable；
+// 嵌套调用时沿用外层事务的选项
+func (m Models) WithTxOptions(ctx context.Context, opts *sql.TxOptions, fn func(Models) error) error {
+	var afterCommit []func()
+	var err error
+	switch {
+	case m.memory != nil:
+		err = m.memory.withTx(ctx, func(tx *memoryStore) error {
+			afterCommit = nil
+			txModels := newMemoryModels(tx)
+			txModels.afterCommit = &afterCommit
+			if m.wrap != nil {
+				txModels = m.wrap(txModels)
+				txModels.wrap = m.wrap
+			}
+			return fn(txModels)
+		})
+	case m.db == nil:
+		return fn(m)
+	default:
+		err = runTx(ctx, m.db, opts, func(tx *sql.Tx) error {
+			// 重试时重新登记
+			afterCommit = nil
+			txModels := newModels(tx)
+			txModels.afterCommit = &afterCommit
+			if m.wrap != nil {
+				txModels = m.wrap(txModels)
+				txModels.wrap = m.wrap
+			}
+			return fn(txModels)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range afterCommit {
+		f()
 	}
+	return nil
 }
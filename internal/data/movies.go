@@ -1,10 +1,15 @@
 package data
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/embracexyz/greenlight/internal/validator"
@@ -19,41 +24,112 @@ type Movie struct {
 	Runtime   Runtime   `json:"runtime"`
 	Genres    []string  `json:",omitempty"`
 	Version   int32     `json:"version"`
+	// 创建和最后修改该电影的用户，用户被删除后为0
+	CreatedBy int64 `json:"created_by,omitempty"`
+	UpdatedBy int64 `json:"updated_by,omitempty"`
+	// 电影所属的组织
+	OrganizationID int64  `json:"organization_id"`
+	Description    string `json:"description,omitempty"`
+	Plot           string `json:"plot,omitempty"`
+	// 全文检索使用的文本搜索配置，决定分词和词干提取
+	Language string `json:"language"`
+	// 全文搜索时匹配内容的摘要，是一段HTML：电影的文本已做HTML转义（与html.EscapeString一致），
+	// 其中只有标出匹配词的<b></b>是标签，可以直接作为HTML渲染
+	Headline string `json:"headline,omitempty"`
+	// 全文搜索的相关度取负值，按升序排序即为相关度从高到低，用于生成游标
+	relevance float32
+}
+
+// 可以使用的文本搜索配置，均为PostgreSQL内置
+var SearchLanguages = []string{"simple", "english", "french", "german", "spanish", "italian", "portuguese", "dutch", "russian"}
+
+const DefaultSearchLanguage = "simple"
+
+// 电影列表可以统计的分面
+var MovieFacets = []string{"genres", "decade", "runtime"}
+
+// 时长分面的区间边界（分钟），划分出<90、90-119、120-149、>=150四个区间
+var runtimeFacetBounds = []int32{90, 120, 150}
+
+// 查询电影列表的过滤条件，零值表示不过滤
+type MovieFilter struct {
+	// 只匹配标题，不计算相关度
+	Title string
+	// 包含所有这些类型
+	Genres []string
+	// 包含其中任意一个类型
+	GenresAny []string
+	// 不包含其中任何一个类型
+	GenresNone []string
+	CreatedBy  int64
+	// 范围均为闭区间
+	YearMin    int32
+	YearMax    int32
+	RuntimeMin Runtime
+	RuntimeMax Runtime
+	// 开区间
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	IDs           []int64
+	// 全文搜索，支持websearch_to_tsquery的语法（"短语"、or、-排除），在标题、类型、简介和剧情中匹配
+	Search string
+	// 解析Search使用的文本搜索配置，应与电影的language一致
+	Language string
+	// 需要统计的分面（MovieFacets），不影响过滤，结果在Metadata.Facets中
+	Facets []string
+}
+
+// 游标所属查询条件的摘要：组织和所有过滤条件，Facets不影响结果因此不计入；空的列表等同于不限
+func (f MovieFilter) cursorScope(orgID int64) string {
+	f.Facets = nil
+	for _, list := range []*[]string{&f.Genres, &f.GenresAny, &f.GenresNone} {
+		if len(*list) == 0 {
+			*list = nil
+		}
+	}
+	if len(f.IDs) == 0 {
+		f.IDs = nil
+	}
+	return cursorScope(struct {
+		OrganizationID int64
+		Filter         MovieFilter
+	}{orgID, f})
 }
 
 type MovieModel struct {
-	DB *sql.DB
+	DB dbtx
 }
 
-func NewMovieModel(db *sql.DB) MovieModel {
+func NewMovieModel(db dbtx) MovieModel {
 	return MovieModel{DB: db}
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	stmt := `
-		insert into movies (title, year, runtime, genres)
-		values ($1, $2, $3, $4)
+		insert into movies (title, year, runtime, genres, created_by, updated_by, organization_id, description, plot, language)
+		values ($1, $2, $3, $4, $5, $5, $6, $7, $8, $9)
 		returning id, created_at, version
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	movie.UpdatedBy = movie.CreatedBy
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy, movie.OrganizationID, movie.Description, movie.Plot, movie.Language}
 	return m.DB.QueryRowContext(ctx, stmt, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, orgID, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
 	query := `
-		delete from movies where id = $1
+		delete from movies where id = $1 and organization_id = $2
 	`
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := m.DB.ExecContext(ctx, query, id, orgID)
 	if err != nil {
 		return err
 	}
@@ -70,17 +146,17 @@ func (m MovieModel) Delete(id int64) error {
 
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	query := `
 		update movies 
-		set title= $1, year = $2, runtime = $3, genres = $4, version = version + 1 
-		where id = $5 and version = $6
+		set title= $1, year = $2, runtime = $3, genres = $4, updated_by = $5, description = $9, plot = $10, language = $11, version = version + 1 
+		where id = $6 and version = $7 and organization_id = $8
 		returning version
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.UpdatedBy, movie.ID, movie.Version, movie.OrganizationID, movie.Description, movie.Plot, movie.Language}
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
 	if err != nil {
@@ -95,22 +171,23 @@ func (m MovieModel) Update(movie *Movie) error {
 }
 
 // 不用uint64 因为pg不支持无符号整数类型，且database/sql最大支持就是int64最大值，uint64可能超过导致panic
-func (m MovieModel) Get(id int64) (*Movie, error) {
+// 其他组织的电影同样返回ErrRecordNotFound，不暴露其是否存在
+func (m MovieModel) Get(ctx context.Context, orgID, id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	query := `
-		select id, created_at, title, year, runtime, genres, version
+		select id, created_at, title, year, runtime, genres, version, coalesce(created_by, 0), coalesce(updated_by, 0), organization_id, description, plot, language
 		from movies
-		where id = $1
+		where id = $1 and organization_id = $2
 	`
 	var movie Movie
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(&movie.ID, &movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres), &movie.Version)
+	err := m.DB.QueryRowContext(ctx, query, id, orgID).Scan(&movie.ID, &movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres), &movie.Version, &movie.CreatedBy, &movie.UpdatedBy, &movie.OrganizationID, &movie.Description, &movie.Plot, &movie.Language)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -124,22 +201,158 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// 排序字段的值，用于生成游标
+var movieSortValues = map[string]func(*Movie) any{
+	"id":        func(movie *Movie) any { return movie.ID },
+	"title":     func(movie *Movie) any { return movie.Title },
+	"year":      func(movie *Movie) any { return int64(movie.Year) },
+	"runtime":   func(movie *Movie) any { return int64(movie.Runtime) },
+	"relevance": func(movie *Movie) any { return movie.relevance },
+}
+
+func movieSortKey(filters Filters) func(*Movie) (any, int64) {
+	value := movieSortValues[filters.SortColumn()]
+	return func(movie *Movie) (any, int64) {
+		return value(movie), movie.ID
+	}
+}
+
+// 把过滤条件加入b，返回相关度和摘要的sql表达式；fuzzy为true时Search按标题模糊匹配
+func (filter MovieFilter) where(b *queryBuilder, orgID int64, fuzzy bool) (relevance, headline string) {
+	b.where("organization_id = %s", orgID)
+	if filter.Title != "" {
+		b.where("to_tsvector('simple', title) @@ plainto_tsquery('simple', %s)", filter.Title)
+	}
+	if len(filter.Genres) > 0 {
+		b.where("genres @> %s", pq.Array(filter.Genres))
+	}
+	if len(filter.GenresAny) > 0 {
+		b.where("genres && %s", pq.Array(filter.GenresAny))
+	}
+	if len(filter.GenresNone) > 0 {
+		b.where("not (genres && %s)", pq.Array(filter.GenresNone))
+	}
+	if filter.CreatedBy != 0 {
+		b.where("created_by = %s", filter.CreatedBy)
+	}
+	if filter.YearMin != 0 {
+		b.where("year >= %s", filter.YearMin)
+	}
+	if filter.YearMax != 0 {
+		b.where("year <= %s", filter.YearMax)
+	}
+	if filter.RuntimeMin != 0 {
+		b.where("runtime >= %s", int32(filter.RuntimeMin))
+	}
+	if filter.RuntimeMax != 0 {
+		b.where("runtime <= %s", int32(filter.RuntimeMax))
+	}
+	if !filter.CreatedAfter.IsZero() {
+		b.where("created_at > %s", filter.CreatedAfter)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		b.where("created_at < %s", filter.CreatedBefore)
+	}
+	if len(filter.IDs) > 0 {
+		b.where("id = any(%s)", pq.Array(filter.IDs))
+	}
+
+	relevance, headline = "0", "''"
+	switch {
+	case filter.Search != "" && fuzzy:
+		search := b.arg(filter.Search)
+		b.where(search + " <%% title")
+		relevance = fmt.Sprintf("-word_similarity(%s, title)", search)
+	case filter.Search != "":
+		language := filter.Language
+		if language == "" {
+			language = DefaultSearchLanguage
+		}
+		config := b.arg(language) + "::regconfig"
+		query := fmt.Sprintf("websearch_to_tsquery(%s, %s)", config, b.arg(filter.Search))
+		b.where("search_vector @@ " + query)
+		relevance = fmt.Sprintf("-ts_rank(search_vector, %s)", query)
+		// 标题等字段由用户填写，先转义再标出匹配的词，否则摘要中会带上未转义的HTML
+		headline = fmt.Sprintf("ts_headline(%s, %s, %s, 'MaxFragments=2, MinWords=5, MaxWords=20, StartSel=<b>, StopSel=</b>')", config, escapeHTMLSQL("concat_ws(' ', title, description, plot)"), query)
+	}
+	return relevance, headline
+}
+
+// 与html.EscapeString相同的转义，&需要最先替换
+func escapeHTMLSQL(text string) string {
+	for _, r := range [][2]string{{"&", "&amp;"}, {"<", "&lt;"}, {">", "&gt;"}, {`"`, "&#34;"}, {"''", "&#39;"}} {
+		text = fmt.Sprintf("replace(%s, '%s', '%s')", text, r[0], r[1])
+	}
+	return text
+}
+
+// 全文搜索没有任何结果时，改为按标题的三元组相似度（pg_trgm）模糊匹配，用于容忍拼写错误；
+// 是否为模糊搜索记录在游标中，之后的翻页沿用同一种方式
+func (m MovieModel) GetAll(ctx context.Context, orgID int64, filter MovieFilter, filters Filters) ([]*Movie, Metadata, error) {
+	if err := filters.bindScope(filter.cursorScope(orgID)); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	movies, metadata, err := m.getAll(ctx, orgID, filter, filters)
+	if err == nil && filter.Search != "" && len(movies) == 0 && !filters.fuzzy && filters.cursor == nil && filters.Page == 1 {
+		filters.fuzzy = true
+		return m.getAll(ctx, orgID, filter, filters)
+	}
+	return movies, metadata, err
+}
+
+// 游标条件放在取当前页的子查询中，可以利用排序列上的索引；游标分页要求计算总数时单独统计filtered，
+// 总数是所有符合过滤条件的电影，而不只是游标之后的；
+// 摘要只为当前页的电影计算（ts_headline开销较大）。
+// 分面与当前页在同一个查询中得到：filtered被引用两次时由postgres物化，只计算一次过滤条件；
+// 当前页左连接到只有一行的分面统计上，当前页为空时（例如超出最后一页）仍有一行带回分面，这一行的found为false
+func (m MovieModel) getAll(ctx context.Context, orgID int64, filter MovieFilter, filters Filters) ([]*Movie, Metadata, error) {
+	var b queryBuilder
+	relevance, headline := filter.where(&b, orgID, filters.fuzzy)
+	facets := movieFacetsSQL(&b, filter.Facets)
+
+	count := "0"
+	switch {
+	case !filters.countTotal():
+	case filters.cursor != nil:
+		count = "(select count(*) from filtered)"
+	default:
+		count = "count(*) over()"
+	}
+
+	keyset := "true"
+	if filters.cursor != nil {
+		keyset = filters.keysetCondition(b.arg(filters.cursor.Value), b.arg(filters.cursor.ID))
+	}
+
 	query := fmt.Sprintf(`
-		select count(*) over(), id, title, year, runtime, genres, version
-		from movies
-		where 
-			(to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) or $1 = '') 
-		and 
-			(genres @> $2 or $2 = '{}') 
-		order by %s %s, id ASC
-		limit $3 offset $4
-	`, filters.SortColumn(), filters.SortDirection())
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		with filtered as (
+			select id, title, year, runtime, genres, version, created_by, updated_by, organization_id, description, plot, language,
+				%s as relevance
+			from movies
+			where %s
+		), page as (
+			select total, id, title, year, runtime, genres, version, created_by, updated_by, organization_id, description, plot, language, relevance
+			from (
+				select %s as total, id, title, year, runtime, genres, version, coalesce(created_by, 0) as created_by, coalesce(updated_by, 0) as updated_by, organization_id, description, plot, language, relevance
+				from filtered
+				where %s
+			) movies
+			order by %s
+			limit %s offset %s
+		)
+		select page.id is not null as found, coalesce(total, 0), coalesce(id, 0), coalesce(title, ''), coalesce(year, 0), coalesce(runtime, 0), coalesce(genres, '{}'),
+			coalesce(version, 0), coalesce(created_by, 0), coalesce(updated_by, 0), coalesce(organization_id, 0), coalesce(description, ''), coalesce(plot, ''),
+			coalesce(language, 'simple'), coalesce(relevance, 0), coalesce(%s, ''), facets.facets
+		from (select %s as facets) facets
+		left join page on true
+		order by %s
+	`, relevance, b.whereSQL(), count, keyset, filters.orderBy(), b.arg(filters.limit()+1), b.arg(filters.offset()), headline, facets, filters.orderBy())
+
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, title, pq.Array(genres), filters.limit(), filters.offset())
+	rows, err := m.DB.QueryContext(ctx, query, b.args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -147,21 +360,150 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	totalRecords := 0
 	movies := []*Movie{}
+	var facetsJSON []byte
 
 	for rows.Next() {
 		var movie Movie
-		err = rows.Scan(&totalRecords, &movie.ID, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres), &movie.Version)
+		var found bool
+		err = rows.Scan(&found, &totalRecords, &movie.ID, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres), &movie.Version, &movie.CreatedBy, &movie.UpdatedBy, &movie.OrganizationID, &movie.Description, &movie.Plot, &movie.Language, &movie.relevance, &movie.Headline, &facetsJSON)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
-		movies = append(movies, &movie)
+		if found {
+			movies = append(movies, &movie)
+		}
 	}
 	err = rows.Err()
 	if err != nil {
 		return nil, Metadata{}, err
 	}
-	return movies, caclMetadata(totalRecords, filters.Page, filters.PageSize), nil
 
+	var counts map[string]map[string]int
+	if facetsJSON != nil {
+		if err = json.Unmarshal(facetsJSON, &counts); err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	movies, metadata := keysetPage(movies, filters, totalRecords, movieSortKey(filters))
+	metadata.Facets = movieFacets(filter.Facets, counts)
+	return movies, metadata, nil
+}
+
+// 分面统计的sql表达式：在filtered（符合过滤条件的电影）上按分面聚合成一个json对象，
+// 每个分面是取值到电影数量的映射，取值分别为类型名、年代的起始年份和时长区间的序号
+func movieFacetsSQL(b *queryBuilder, facets []string) string {
+	if len(facets) == 0 {
+		return "null"
+	}
+	fields := make([]string, 0, len(facets))
+	for _, facet := range facets {
+		var counts string
+		switch facet {
+		case "genres":
+			counts = "select genre as value, count(*) as n from filtered, unnest(genres) as genre group by genre"
+		case "decade":
+			counts = "select year / 10 * 10 as value, count(*) as n from filtered group by 1"
+		case "runtime":
+			// width_bucket返回小于等于runtime的边界个数，即时长区间的序号
+			counts = fmt.Sprintf("select width_bucket(runtime, %s::integer[]) as value, count(*) as n from filtered group by 1", b.arg(pq.Array(runtimeFacetBounds)))
+		}
+		fields = append(fields, fmt.Sprintf("'%s', (select json_object_agg(value, n) from (%s) as counts)", facet, counts))
+	}
+	return "json_build_object(" + strings.Join(fields, ", ") + ")"
+}
+
+// 把各分面的计数转换为Metadata.Facets：类型按数量从多到少排列，年代和时长按区间从小到大排列；
+// 没有符合条件的电影时，请求的分面为空数组
+func movieFacets(facets []string, counts map[string]map[string]int) map[string][]FacetCount {
+	if len(facets) == 0 {
+		return nil
+	}
+	result := make(map[string][]FacetCount, len(facets))
+	for _, facet := range facets {
+		values := []FacetCount{}
+		for key, n := range counts[facet] {
+			value := FacetCount{Value: key}
+			switch facet {
+			case "decade":
+				start, _ := strconv.Atoi(key)
+				value = FacetCount{Value: key + "s", Min: int32(start), Max: int32(start + 9)}
+			case "runtime":
+				bucket, _ := strconv.Atoi(key)
+				value = runtimeFacet(bucket)
+			}
+			value.Count = n
+			values = append(values, value)
+		}
+		slices.SortFunc(values, func(a, b FacetCount) int {
+			if facet == "genres" {
+				return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Value, b.Value))
+			}
+			return cmp.Compare(a.Min, b.Min)
+		})
+		result[facet] = values
+	}
+	return result
+}
+
+// 第bucket个时长区间，与width_bucket的序号一致
+func runtimeFacet(bucket int) FacetCount {
+	var value FacetCount
+	if bucket > 0 {
+		value.Min = runtimeFacetBounds[bucket-1]
+	}
+	if bucket < len(runtimeFacetBounds) {
+		value.Max = runtimeFacetBounds[bucket] - 1
+		value.Value = fmt.Sprintf("%d-%d mins", value.Min, value.Max)
+	} else {
+		value.Value = fmt.Sprintf("%d+ mins", value.Min)
+	}
+	return value
+}
+
+// 标题补全的候选
+type Suggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+// 用于输入时的自动补全：以q开头的标题排在前面，其余按与q的三元组相似度排序；
+// 两种条件都可以使用标题上的gin_trgm_ops索引
+func (m MovieModel) Suggest(ctx context.Context, orgID int64, q string, limit int) ([]*Suggestion, error) {
+	query := `
+		select id, title
+		from movies
+		where organization_id = $1 and (title ilike $2 or $3 <% title)
+		order by title ilike $2 desc, word_similarity($3, title) desc, title, id
+		limit $4`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, orgID, escapeLike(q)+"%", q, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*Suggestion{}
+	for rows.Next() {
+		var suggestion Suggestion
+		err = rows.Scan(&suggestion.ID, &suggestion.Title)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return suggestions, nil
+}
+
+// 转义like模式中的通配符，使q按字面匹配
+func escapeLike(q string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q)
 }
 func ValidateMove(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Title != "", "title", "must be provided")
@@ -175,4 +517,37 @@ func ValidateMove(v *validator.Validator, movie *Movie) {
 	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
 	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	v.Check(len(movie.Description) <= 2000, "description", "must not be more than 2000 bytes long")
+	v.Check(len(movie.Plot) <= 20000, "plot", "must not be more than 20000 bytes long")
+	v.Check(validator.In(movie.Language, SearchLanguages...), "language", "must be a supported search language")
+}
+
+func ValidateSuggestion(v *validator.Validator, q string, limit int) {
+	v.Check(q != "", "q", "must be provided")
+	v.Check(len(q) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
+}
+
+func ValidateMovieFilter(v *validator.Validator, filter MovieFilter) {
+	v.Check(filter.CreatedBy >= 0, "created_by", "must be a positive integer")
+	v.Check(filter.YearMin >= 0, "year_min", "must be a positive integer")
+	v.Check(filter.YearMax >= 0, "year_max", "must be a positive integer")
+	v.Check(filter.YearMin == 0 || filter.YearMax == 0 || filter.YearMin <= filter.YearMax, "year_min", "must not be greater than year_max")
+	v.Check(filter.RuntimeMin >= 0, "runtime_min", "must be a positive integer")
+	v.Check(filter.RuntimeMax >= 0, "runtime_max", "must be a positive integer")
+	v.Check(filter.RuntimeMin == 0 || filter.RuntimeMax == 0 || filter.RuntimeMin <= filter.RuntimeMax, "runtime_min", "must not be greater than runtime_max")
+	v.Check(filter.CreatedAfter.IsZero() || filter.CreatedBefore.IsZero() || filter.CreatedAfter.Before(filter.CreatedBefore), "created_after", "must be before created_before")
+	v.Check(len(filter.GenresAny) <= 20, "genres_any", "must not contain more than 20 genres")
+	v.Check(len(filter.GenresNone) <= 20, "genres_none", "must not contain more than 20 genres")
+	v.Check(len(filter.IDs) <= 100, "ids", "must not contain more than 100 ids")
+	for _, id := range filter.IDs {
+		v.Check(id > 0, "ids", "must contain only positive integers")
+	}
+	v.Check(len(filter.Search) <= 500, "q", "must not be more than 500 bytes long")
+	v.Check(filter.Language == "" || validator.In(filter.Language, SearchLanguages...), "language", "must be a supported search language")
+	for _, facet := range filter.Facets {
+		v.Check(validator.In(facet, MovieFacets...), "facets", "must contain only genres, decade or runtime")
+	}
+	v.Check(validator.Unique(filter.Facets), "facets", "must not contain duplicate values")
 }
@@ -0,0 +1,253 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// 组织（租户），电影属于某一个组织，用户通过membership加入组织并拥有组织内的角色
+type Organization struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role,omitempty"` // 查询用户所属组织时，用户在该组织中的角色
+}
+
+type Membership struct {
+	OrganizationID int64     `json:"organization_id"`
+	UserID         int64     `json:"user_id"`
+	Role           string    `json:"role"`
+	CreatedAt      time.Time `json:"created_at"`
+	// 成员角色在该组织内授予的权限，只在GetMembership中查询
+	Permissions Permisions `json:"-"`
+}
+
+// 组织成员可以被授予的角色
+var MembershipRoles = []string{"viewer", "editor", "owner"}
+
+// 注册时为用户创建的个人组织的名称
+const PersonalOrganizationName = "Personal"
+
+// 按组织授权的资源：这些资源的权限只来自用户在组织中的角色，全局授予的权限（包括全局角色）不适用
+var organizationResources = []string{"movies", "organizations"}
+
+// 权限属于按组织授权的资源，只能通过组织内的角色获得，不能全局授予
+func IsOrganizationPermission(code string) bool {
+	resource, _, _ := strings.Cut(code, ":")
+	return slices.Contains(organizationResources, resource)
+}
+
+// 用户在组织内的有效权限：成员角色的权限，加上全局授予中与组织内资源无关的部分（例如admin:*）；
+// 首段为通配符的全局授予可能匹配组织内的资源，同样不计入
+func (m *Membership) ScopePermissions(global Permisions) Permisions {
+	permissions := slices.Clone(m.Permissions)
+	for _, code := range global {
+		if !strings.HasPrefix(code, "*") && !IsOrganizationPermission(code) {
+			permissions = append(permissions, code)
+		}
+	}
+	return permissions
+}
+
+type OrganizationModel struct {
+	DB dbtx
+}
+
+func NewOrganizationModel(db dbtx) OrganizationModel {
+	return OrganizationModel{DB: db}
+}
+
+// 创建组织，创建者成为组织的owner
+func (m OrganizationModel) Insert(ctx context.Context, org *Organization, ownerID int64) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx dbtx) error {
+		query := `
+			insert into organizations (name)
+			values ($1)
+			returning id, created_at`
+
+		err := tx.QueryRowContext(ctx, query, org.Name).Scan(&org.ID, &org.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			insert into memberships (organization_id, user_id, role_id)
+			select $1, $2, roles.id from roles where roles.name = 'owner'`
+
+		_, err = tx.ExecContext(ctx, query, org.ID, ownerID)
+		if err != nil {
+			return err
+		}
+		org.Role = "owner"
+		return nil
+	})
+}
+
+// 用户所属的所有组织
+func (m OrganizationModel) GetAllForUser(ctx context.Context, userID int64) ([]*Organization, error) {
+	query := `
+		select organizations.id, organizations.created_at, organizations.name, roles.name
+		from organizations
+		inner join memberships on memberships.organization_id = organizations.id
+		inner join roles on memberships.role_id = roles.id
+		where memberships.user_id = $1
+		order by organizations.id`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []*Organization{}
+	for rows.Next() {
+		var org Organization
+		err = rows.Scan(&org.ID, &org.CreatedAt, &org.Name, &org.Role)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, &org)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+// 用户在组织中的成员关系，以及其角色拥有的权限；不是成员时返回ErrRecordNotFound
+func (m OrganizationModel) GetMembership(ctx context.Context, orgID, userID int64) (*Membership, error) {
+	query := `
+		select memberships.organization_id, memberships.user_id, roles.name, memberships.created_at,
+			array(
+				select permissions.code
+				from permissions
+				inner join roles_permissions on roles_permissions.permission_id = permissions.id
+				where roles_permissions.role_id = memberships.role_id
+				order by permissions.code
+			)
+		from memberships
+		inner join roles on memberships.role_id = roles.id
+		where memberships.organization_id = $1 and memberships.user_id = $2`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var membership Membership
+	err := m.DB.QueryRowContext(ctx, query, orgID, userID).Scan(&membership.OrganizationID, &membership.UserID, &membership.Role, &membership.CreatedAt, pq.Array(&membership.Permissions))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &membership, nil
+}
+
+// 组织的所有成员
+func (m OrganizationModel) GetMembers(ctx context.Context, orgID int64) ([]*Membership, error) {
+	query := `
+		select memberships.organization_id, memberships.user_id, roles.name, memberships.created_at
+		from memberships
+		inner join roles on memberships.role_id = roles.id
+		where memberships.organization_id = $1
+		order by memberships.user_id`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*Membership{}
+	for rows.Next() {
+		var membership Membership
+		err = rows.Scan(&membership.OrganizationID, &membership.UserID, &membership.Role, &membership.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, &membership)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// 添加成员或修改成员的角色；用户或角色不存在时返回ErrRecordNotFound
+func (m OrganizationModel) SetMember(ctx context.Context, membership *Membership) error {
+	query := `
+		insert into memberships (organization_id, user_id, role_id)
+		select $1, $2, roles.id from roles where roles.name = $3
+		on conflict (organization_id, user_id) do update set role_id = EXCLUDED.role_id
+		returning created_at`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, membership.OrganizationID, membership.UserID, membership.Role).Scan(&membership.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			// 外键约束：用户或组织不存在
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// 移除组织成员，不是成员时返回ErrRecordNotFound
+func (m OrganizationModel) RemoveMember(ctx context.Context, orgID, userID int64) error {
+	query := `
+		delete from memberships
+		where organization_id = $1 and user_id = $2`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func ValidateMembership(v *validator.Validator, membership *Membership) {
+	v.Check(membership.UserID > 0, "user_id", "must be a positive integer")
+	v.Check(validator.In(membership.Role, MembershipRoles...), "role", "must be one of viewer, editor or owner")
+}
+
+func ValidateOrganization(v *validator.Validator, org *Organization) {
+	v.Check(org.Name != "", "name", "must be provided")
+	v.Check(len(org.Name) <= 200, "name", "must not be more than 200 bytes long")
+}
@@ -0,0 +1,254 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordAlgorithmArgon2id = "argon2id"
+	PasswordAlgorithmBcrypt   = "bcrypt"
+
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+
+	// argon2id对密码长度没有限制，这里只是避免超长的输入拖慢哈希计算
+	maxPasswordLength = 1024
+	// bcrypt只使用密码的前72个字节
+	maxBcryptPasswordLength = 72
+)
+
+var (
+	ErrInvalidPasswordHash = errors.New("invalid password hash")
+)
+
+// 哈希算法及其参数；argon2id的哈希以PHC格式保存，参数随哈希一起保存，
+// 因此调整参数或算法后旧的哈希依然可以校验，并在登录时升级
+type PasswordParams struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Time    uint32
+	Argon2Memory  uint32 // KiB
+	Argon2Threads uint8
+}
+
+var DefaultPasswordParams = PasswordParams{
+	Algorithm:     PasswordAlgorithmArgon2id,
+	BcryptCost:    12,
+	Argon2Time:    1,
+	Argon2Memory:  64 * 1024,
+	Argon2Threads: 4,
+}
+
+// 当前用于生成新哈希的参数，启动时通过SetPasswordParams设置
+var passwordParams = DefaultPasswordParams
+
+func SetPasswordParams(params PasswordParams) error {
+	err := params.validate()
+	if err != nil {
+		return err
+	}
+	passwordParams = params
+	return nil
+}
+
+func (p PasswordParams) validate() error {
+	switch p.Algorithm {
+	case PasswordAlgorithmArgon2id:
+		if p.Argon2Time < 1 || p.Argon2Threads < 1 || p.Argon2Memory < 8*uint32(p.Argon2Threads) {
+			return fmt.Errorf("invalid argon2id parameters t=%d m=%d p=%d", p.Argon2Time, p.Argon2Memory, p.Argon2Threads)
+		}
+	case PasswordAlgorithmBcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("invalid bcrypt cost %d", p.BcryptCost)
+		}
+	default:
+		return fmt.Errorf("unsupported password algorithm %q", p.Algorithm)
+	}
+	return nil
+}
+
+// 当前算法允许的最大密码长度
+func (p PasswordParams) MaxLength() int {
+	if p.Algorithm == PasswordAlgorithmBcrypt {
+		return maxBcryptPasswordLength
+	}
+	return maxPasswordLength
+}
+
+func (p PasswordParams) hash(plaintextPassword string) ([]byte, error) {
+	switch p.Algorithm {
+	case PasswordAlgorithmBcrypt:
+		return bcrypt.GenerateFromPassword([]byte(plaintextPassword), p.BcryptCost)
+	case PasswordAlgorithmArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+
+		key := argon2.IDKey([]byte(plaintextPassword), salt, p.Argon2Time, p.Argon2Memory, p.Argon2Threads, argon2KeyLen)
+		encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, p.Argon2Memory, p.Argon2Time, p.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+		return []byte(encoded), nil
+	default:
+		return nil, fmt.Errorf("unsupported password algorithm %q", p.Algorithm)
+	}
+}
+
+// 测量一次哈希的耗时；target大于0时逐步提高参数（argon2id的迭代次数、bcrypt的cost），
+// 直到单次哈希耗时达到target，返回调整后的参数
+func BenchmarkPasswordParams(params PasswordParams, target time.Duration) (PasswordParams, time.Duration, error) {
+	err := params.validate()
+	if err != nil {
+		return params, 0, err
+	}
+
+	measure := func(p PasswordParams) (time.Duration, error) {
+		start := time.Now()
+		_, err := p.hash("greenlight-password-benchmark")
+		return time.Since(start), err
+	}
+
+	elapsed, err := measure(params)
+	if err != nil {
+		return params, 0, err
+	}
+
+	for target > 0 && elapsed < target {
+		next := params
+		switch params.Algorithm {
+		case PasswordAlgorithmArgon2id:
+			if next.Argon2Time >= 64 {
+				return params, elapsed, nil
+			}
+			next.Argon2Time++
+		case PasswordAlgorithmBcrypt:
+			if next.BcryptCost >= bcrypt.MaxCost {
+				return params, elapsed, nil
+			}
+			next.BcryptCost++
+		}
+
+		elapsed, err = measure(next)
+		if err != nil {
+			return params, 0, err
+		}
+		params = next
+	}
+	return params, elapsed, nil
+}
+
+// 解析argon2id的PHC格式哈希
+func decodeArgon2Hash(hash []byte) (PasswordParams, []byte, []byte, error) {
+	params := PasswordParams{Algorithm: PasswordAlgorithmArgon2id}
+
+	parts := bytes.Split(hash, []byte("$"))
+	if len(parts) != 6 || string(parts[1]) != PasswordAlgorithmArgon2id {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(string(parts[2]), "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	_, err = fmt.Sscanf(string(parts[3]), "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads)
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(string(parts[4]))
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(string(parts[5]))
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	return params, salt, key, nil
+}
+
+func isArgon2Hash(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$argon2id$"))
+}
+
+type password struct {
+	plaintext *string // 指针可以通过nil判断是否传值了
+	hash      []byte
+}
+
+func (p *password) Set(plaintextPassword string) error {
+	hash, err := passwordParams.hash(plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	p.plaintext = &plaintextPassword
+	p.hash = hash
+	return nil
+}
+
+// 根据哈希的前缀选择算法，bcrypt和argon2id的哈希都可以校验
+func (p *password) Matches(plaintextPassword string) (bool, error) {
+	if isArgon2Hash(p.hash) {
+		params, salt, key, err := decodeArgon2Hash(p.hash)
+		if err != nil {
+			return false, err
+		}
+
+		other := argon2.IDKey([]byte(plaintextPassword), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// 当前算法可以哈希该密码
+func PasswordFitsAlgorithm(plaintextPassword string) bool {
+	return len(plaintextPassword) <= passwordParams.MaxLength()
+}
+
+// 哈希的算法或参数与当前配置不一致时需要重新哈希
+func (p *password) NeedsRehash() bool {
+	current := passwordParams
+
+	if isArgon2Hash(p.hash) {
+		if current.Algorithm != PasswordAlgorithmArgon2id {
+			return true
+		}
+		params, _, key, err := decodeArgon2Hash(p.hash)
+		if err != nil {
+			return true
+		}
+		return params.Argon2Time != current.Argon2Time ||
+			params.Argon2Memory != current.Argon2Memory ||
+			params.Argon2Threads != current.Argon2Threads ||
+			len(key) != argon2KeyLen
+	}
+
+	if current.Algorithm != PasswordAlgorithmBcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost(p.hash)
+	return err != nil || cost != current.BcryptCost
+}
@@ -2,43 +2,128 @@ package data
 
 import (
 	"context"
-	"database/sql"
-	"time"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
 
+	"github.com/embracexyz/greenlight/internal/validator"
 	"github.com/lib/pq"
 )
 
+var (
+	ErrDuplicatePermission = errors.New("duplicate permission")
+)
+
+// 权限code由":"分隔的若干段组成，例如"movies:read"、"movies:write:own"。
+// 授予的code中可以用"*"代替一整段：
+//   - 非末尾的"*"匹配恰好一段，例如"*:read"匹配"movies:read"，不匹配"movies:write:read"
+//   - 末尾的"*"匹配剩余的一段或多段，例如"movies:*"匹配"movies:read"和"movies:write:own"
+//   - 单独的"*"匹配所有code
+//
+// 其余段必须完全相同；需要校验的code本身不包含通配符
 type Permisions []string
 
+// 是否拥有code对应的权限
 func (p Permisions) Include(code string) bool {
 	for i := range p {
-		if code == p[i] {
+		if matchPermission(p[i], code) {
 			return true
 		}
 	}
 	return false
 }
 
+// 拥有codes中的任意一个权限
+func (p Permisions) IncludeAny(codes ...string) bool {
+	for _, code := range codes {
+		if p.Include(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// 拥有codes中的所有权限
+func (p Permisions) IncludeAll(codes ...string) bool {
+	for _, code := range codes {
+		if !p.Include(code) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchPermission(granted, code string) bool {
+	if granted == code {
+		return true
+	}
+
+	patterns := strings.Split(granted, ":")
+	segments := strings.Split(code, ":")
+	for i, pattern := range patterns {
+		if pattern == "*" && i == len(patterns)-1 {
+			return len(segments) > i
+		}
+		if i >= len(segments) || (pattern != "*" && pattern != segments[i]) {
+			return false
+		}
+	}
+	return len(patterns) == len(segments)
+}
+
+var permissionSegmentRX = regexp.MustCompile(`^([a-z][a-z0-9_-]*|\*)$`)
+
 type PermisionModel struct {
-	DB *sql.DB
+	DB dbtx
 }
 
-func NewPermisionModel(db *sql.DB) PermisionModel {
+func NewPermisionModel(db dbtx) PermisionModel {
 	return PermisionModel{DB: db}
 }
 
-func (p PermisionModel) GetAllForUser(userID int64) (Permisions, error) {
+// 用户的有效权限：直接授予的权限加上所属角色的权限
+func (p PermisionModel) GetAllForUser(ctx context.Context, userID int64) (Permisions, error) {
+	query := `
+		select permissions.code
+		from permissions
+		inner join users_permissions on users_permissions.permission_id = permissions.id
+		where users_permissions.user_id = $1
+		union
+		select permissions.code
+		from permissions
+		inner join roles_permissions on roles_permissions.permission_id = permissions.id
+		inner join users_roles on users_roles.role_id = roles_permissions.role_id
+		where users_roles.user_id = $1
+		order by code
+	`
+	return p.queryCodes(ctx, query, userID)
+}
+
+// 只包含直接授予用户的权限
+func (p PermisionModel) GetDirectForUser(ctx context.Context, userID int64) (Permisions, error) {
 	query := `
 		select permissions.code
 		from permissions
 		inner join users_permissions on users_permissions.permission_id = permissions.id
-		inner join users on users_permissions.user_id = users.id
-		where users.id = $1
+		where users_permissions.user_id = $1
+		order by permissions.code
+	`
+	return p.queryCodes(ctx, query, userID)
+}
+
+func (p PermisionModel) GetAll(ctx context.Context) (Permisions, error) {
+	query := `
+		select code from permissions order by code
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return p.queryCodes(ctx, query)
+}
+
+func (p PermisionModel) queryCodes(ctx context.Context, query string, args ...interface{}) (Permisions, error) {
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
-	rows, err := p.DB.QueryContext(ctx, query, userID)
+	rows, err := p.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -59,14 +144,95 @@ func (p PermisionModel) GetAllForUser(userID int64) (Permisions, error) {
 	return permissions, nil
 }
 
-func (p PermisionModel) AddForUser(userID int64, codes ...string) error {
+// 授予用户权限，已经拥有的权限会被忽略；任一code不存在时返回ErrRecordNotFound
+func (p PermisionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	codes = uniqueCodes(codes)
 	query := `
-		insert into users_permissions
-		select $1, permissions.id from permissions where permissions.code = any($2)
+		with codes as (
+			select permissions.id from permissions where permissions.code = any($2)
+		), granted as (
+			insert into users_permissions
+			select $1, id from codes
+			where (select count(*) from codes) = cardinality($2::text[])
+			on conflict do nothing
+		)
+		select count(*) from codes
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
-	_, err := p.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	var found int
+	err := p.DB.QueryRowContext(ctx, query, userID, pq.Array(codes)).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found != len(codes) {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 去掉重复的code，重复的code只授予一次，不影响是否所有code都存在的判断
+func uniqueCodes(codes []string) []string {
+	codes = slices.Clone(codes)
+	slices.Sort(codes)
+	return slices.Compact(codes)
+}
+
+func (p PermisionModel) RemoveForUser(ctx context.Context, userID int64, code string) error {
+	query := `
+		delete from users_permissions
+		using permissions
+		where users_permissions.permission_id = permissions.id
+		and users_permissions.user_id = $1 and permissions.code = $2
+	`
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := p.DB.ExecContext(ctx, query, userID, code)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 新建权限code
+func (p PermisionModel) Insert(ctx context.Context, code string) error {
+	query := `
+		insert into permissions (code) values ($1)
+	`
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := p.DB.ExecContext(ctx, query, code)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrDuplicatePermission
+		}
+		return err
+	}
+	return nil
+}
+
+func ValidatePermissionCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) <= 100, "code", "must not be more than 100 bytes long")
+
+	segments := strings.Split(code, ":")
+	v.Check(len(segments) <= 5, "code", "must not contain more than 5 segments")
+	for _, segment := range segments {
+		if !validator.Matches(segment, permissionSegmentRX) {
+			v.AddFieldError("code", "segments must be lowercase identifiers or \"*\" separated by \":\"")
+			break
+		}
+	}
 }
@@ -0,0 +1,36 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 组装动态的where条件：条件中的值一律通过占位符传入，sql文本中只出现调用方写死的列名和运算符，
+// 避免随着过滤条件增多，在一个fmt.Sprintf中手工维护占位符的编号
+type queryBuilder struct {
+	args       []any
+	conditions []string
+}
+
+// 添加一个参数，返回它的占位符
+func (b *queryBuilder) arg(value any) string {
+	b.args = append(b.args, value)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+// 添加一个条件，format中的每个%s依次替换为values对应的占位符，sql中的%需要写成%%
+func (b *queryBuilder) where(format string, values ...any) {
+	placeholders := make([]any, len(values))
+	for i, value := range values {
+		placeholders[i] = b.arg(value)
+	}
+	b.conditions = append(b.conditions, fmt.Sprintf(format, placeholders...))
+}
+
+// 用and连接所有条件，没有条件时为true
+func (b *queryBuilder) whereSQL() string {
+	if len(b.conditions) == 0 {
+		return "true"
+	}
+	return strings.Join(b.conditions, " and ")
+}
@@ -0,0 +1,139 @@
+package data
+
+import (
+	"context"
+
+	"github.com/lib/pq"
+)
+
+// 角色是一组权限code的集合，用户通过users_roles获得角色下的所有权限
+type Role struct {
+	ID          int64      `json:"id"`
+	Name        string     `json:"name"`
+	Permissions Permisions `json:"permissions"`
+}
+
+type RoleModel struct {
+	DB dbtx
+}
+
+func NewRoleModel(db dbtx) RoleModel {
+	return RoleModel{DB: db}
+}
+
+func (m RoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	query := `
+		select roles.id, roles.name, coalesce(array_agg(permissions.code order by permissions.code) filter (where permissions.code is not null), '{}')
+		from roles
+		left join roles_permissions on roles_permissions.role_id = roles.id
+		left join permissions on roles_permissions.permission_id = permissions.id
+		group by roles.id
+		order by roles.id
+	`
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		err = rows.Scan(&role.ID, &role.Name, pq.Array(&role.Permissions))
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// 用户拥有的角色名
+func (m RoleModel) GetAllForUser(ctx context.Context, userID int64) ([]string, error) {
+	query := `
+		select roles.name
+		from roles
+		inner join users_roles on users_roles.role_id = roles.id
+		where users_roles.user_id = $1
+		order by roles.name
+	`
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		err = rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// 给用户分配角色，已经拥有时忽略；角色不存在时返回ErrRecordNotFound
+func (m RoleModel) AddForUser(ctx context.Context, userID int64, name string) error {
+	query := `
+		with found_role as (
+			select id from roles where name = $2
+		), assigned as (
+			insert into users_roles
+			select $1, id from found_role
+			on conflict do nothing
+		)
+		select count(*) from found_role
+	`
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var found int
+	err := m.DB.QueryRowContext(ctx, query, userID, name).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m RoleModel) RemoveForUser(ctx context.Context, userID int64, name string) error {
+	query := `
+		delete from users_roles
+		using roles
+		where users_roles.role_id = roles.id
+		and users_roles.user_id = $1 and roles.name = $2
+	`
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
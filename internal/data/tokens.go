@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/embracexyz/greenlight/internal/validator"
@@ -15,6 +16,15 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeMFAPending     = "mfa-pending"
+	ScopeMFARecovery    = "mfa-recovery"
+	ScopeEmailChange    = "email-change"
+	ScopeMagicLink      = "magic-link"
+)
+
+var (
+	ErrTokenReused = errors.New("token reused")
 )
 
 type Token struct {
@@ -23,6 +33,7 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	Family    string    `json:"-"` // 同一次登录轮换出来的refresh token共享一个family
 }
 
 func ValidatorToken(v *validator.Validator, tokenPlainText string) {
@@ -31,10 +42,10 @@ func ValidatorToken(v *validator.Validator, tokenPlainText string) {
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB dbtx
 }
 
-func NewTokenModel(db *sql.DB) TokenModel {
+func NewTokenModel(db dbtx) TokenModel {
 	return TokenModel{DB: db}
 }
 
@@ -52,7 +63,7 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 		return nil, err
 	}
 
-	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	token.Plaintext = randomString(randomBytes)
 
 	hash := sha256.Sum256([]byte(token.Plaintext))
 	// 将数组转为slice
@@ -61,42 +72,189 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
-func (m TokenModel) Insert(token *Token) error {
+func randomString(randomBytes []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+}
+
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+		INSERT INTO tokens (hash, user_id, expiry, scope, family)
+		VALUES ($1, $2, $3, $4, $5)`
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.Family}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// 生成refresh token，family为空时开启一个新的family（即一次新的登录）
+func (m TokenModel) NewRefresh(ctx context.Context, userID int64, ttl time.Duration, family string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	if family == "" {
+		family, err = newTokenFamily()
+		if err != nil {
+			return nil, err
+		}
+	}
+	token.Family = family
+
+	err = m.Insert(ctx, token)
 	if err != nil {
 		return nil, err
 	}
 	return token, nil
 }
 
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func newTokenFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return randomString(randomBytes), nil
+}
+
+// 兑换refresh token：标记为已使用并返回该token；
+// 如果该token此前已经被使用过，同样返回token，但err为ErrTokenReused，由调用方吊销整个family
+func (m TokenModel) ConsumeRefresh(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		WITH old AS (
+			SELECT hash, used FROM tokens
+			WHERE hash = $1 AND scope = $2 AND expiry > $3
+			FOR UPDATE
+		)
+		UPDATE tokens SET used = true
+		FROM old
+		WHERE tokens.hash = old.hash
+		RETURNING tokens.user_id, tokens.expiry, tokens.family, old.used`
+	args := []interface{}{hash[:], ScopeRefresh, time.Now()}
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	token := &Token{
+		Plaintext: tokenPlaintext,
+		Hash:      hash[:],
+		Scope:     ScopeRefresh,
+	}
+	var used bool
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&token.UserID, &token.Expiry, &token.Family, &used)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if used {
+		return token, ErrTokenReused
+	}
+	return token, nil
+}
+
+func (m TokenModel) DeleteFamily(ctx context.Context, family string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND family = $2`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ScopeRefresh, family)
+	return err
+}
+
+// 一次性使用token：属于该用户且未过期时删除，否则返回ErrRecordNotFound
+func (m TokenModel) Consume(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND user_id = $3 AND expiry > $4`
+	args := []interface{}{hash[:], scope, userID, time.Now()}
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
 		DELETE FROM tokens
 		WHERE scope = $1 AND user_id = $2`
 
 	args := []interface{}{scope, userID}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
+
+// 用户的所有token（不含明文和hash），用于数据导出
+func (m TokenModel) GetAllForUser(ctx context.Context, userID int64) ([]*Token, error) {
+	query := `
+		SELECT user_id, expiry, scope
+		FROM tokens
+		WHERE user_id = $1
+		ORDER BY expiry`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+	for rows.Next() {
+		var token Token
+		err = rows.Scan(&token.UserID, &token.Expiry, &token.Scope)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
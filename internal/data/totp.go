@@ -0,0 +1,128 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/embracexyz/greenlight/internal/validator"
+)
+
+// 用户的TOTP secret，confirmed之前只是登记，不参与登录校验
+type TOTP struct {
+	UserID    int64
+	CreatedAt time.Time
+	Secret    string
+	Confirmed bool
+	LastStep  int64
+}
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+type TOTPModel struct {
+	DB dbtx
+}
+
+func NewTOTPModel(db dbtx) TOTPModel {
+	return TOTPModel{DB: db}
+}
+
+// 登记新的secret，覆盖此前未确认的secret；已确认的secret不会被覆盖
+func (m TOTPModel) Insert(ctx context.Context, totp *TOTP) error {
+	query := `
+		INSERT INTO totp_secrets (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = NOW(), last_step = 0
+		WHERE totp_secrets.confirmed = false
+		RETURNING created_at, confirmed`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, totp.UserID, totp.Secret).Scan(&totp.CreatedAt, &totp.Confirmed)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m TOTPModel) Get(ctx context.Context, userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, created_at, secret, confirmed, last_step
+		FROM totp_secrets
+		WHERE user_id = $1`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var totp TOTP
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&totp.UserID, &totp.CreatedAt, &totp.Secret, &totp.Confirmed, &totp.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &totp, nil
+}
+
+// 记录验证码所在的时间窗口并确认secret；同一窗口（或更早）的验证码不能再次使用，
+// 返回ErrEditConflict表示验证码被重放
+func (m TOTPModel) Use(ctx context.Context, userID, step int64) error {
+	query := `
+		UPDATE totp_secrets SET last_step = $2, confirmed = true
+		WHERE user_id = $1 AND last_step < $2`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+func (m TOTPModel) Delete(ctx context.Context, userID int64) error {
+	query := `
+		DELETE FROM totp_secrets WHERE user_id = $1`
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
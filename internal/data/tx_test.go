@@ -0,0 +1,241 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// 尚未保存的用户，提交后的用例结束时删除
+func unsavedTestUser(t *testing.T, m Models) *User {
+	t.Helper()
+
+	user := &User{
+		Name:  "Test User",
+		Email: fmt.Sprintf("tx-%d-%d@example.com", time.Now().UnixNano(), testSeq.Add(1)),
+	}
+	if err := user.Password.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stored, err := m.UserModel.GetByEmail(context.Background(), user.Email)
+		if err == nil {
+			err = m.UserModel.Delete(context.Background(), stored.ID)
+		}
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			t.Error(err)
+		}
+	})
+	return user
+}
+
+// 与注册流程相同：插入用户后授予默认权限，授予失败时用户也不应保存下来
+func TestWithTxRollback(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+
+		tests := []struct {
+			name    string
+			codes   []string
+			wantErr error
+		}{
+			{"commit", []string{"movies:read"}, nil},
+			{"unknown permission rolls back", []string{"movies:read", "movies:unknown"}, ErrRecordNotFound},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				user := unsavedTestUser(t, m)
+				err := m.WithTx(ctx, func(m Models) error {
+					if err := m.UserModel.Insert(ctx, user); err != nil {
+						return err
+					}
+					return m.PermisionModel.AddForUser(ctx, user.ID, tt.codes...)
+				})
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+
+				stored, err := m.UserModel.GetByEmail(ctx, user.Email)
+				if tt.wantErr != nil {
+					if !errors.Is(err, ErrRecordNotFound) {
+						t.Errorf("user after rollback: got %v, want ErrRecordNotFound", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				permissions, err := m.PermisionModel.GetAllForUser(ctx, stored.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(permissions, Permisions(tt.codes)) {
+					t.Errorf("permissions = %v, want %v", permissions, tt.codes)
+				}
+			})
+		}
+	})
+}
+
+// 嵌套的WithTx复用外层事务，外层回滚时内层已完成的写入也一起撤销
+func TestWithTxNestedRollback(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		user := unsavedTestUser(t, m)
+		errAbort := errors.New("abort")
+
+		err := m.WithTx(ctx, func(m Models) error {
+			err := m.WithTx(ctx, func(m Models) error {
+				return m.UserModel.Insert(ctx, user)
+			})
+			if err != nil {
+				return err
+			}
+			return errAbort
+		})
+		if !errors.Is(err, errAbort) {
+			t.Fatalf("got %v, want %v", err, errAbort)
+		}
+		if _, err := m.UserModel.GetByEmail(ctx, user.Email); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("user after rollback: got %v, want ErrRecordNotFound", err)
+		}
+	})
+}
+
+// 事务中的写操作在提交后使缓存失效，之后读到的是提交后的数据；回滚时缓存中也不会留下未提交的数据
+func TestWithTxCachedModels(t *testing.T) {
+	runConformance(t, func(t *testing.T, m Models) {
+		ctx := context.Background()
+		m = NewCachedModels(m, time.Minute)
+		user := newTestUser(t, m)
+
+		// 写入缓存
+		if _, err := m.UserModel.Get(ctx, user.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		errAbort := errors.New("abort")
+		err := m.WithTx(ctx, func(m Models) error {
+			user.Name = "Rolled Back"
+			if err := m.UserModel.Update(ctx, user); err != nil {
+				return err
+			}
+			if _, err := m.UserModel.Get(ctx, user.ID); err != nil {
+				return err
+			}
+			return errAbort
+		})
+		if !errors.Is(err, errAbort) {
+			t.Fatalf("got %v, want %v", err, errAbort)
+		}
+		stored, err := m.UserModel.Get(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Name != "Test User" {
+			t.Errorf("name after rollback = %q, want %q", stored.Name, "Test User")
+		}
+
+		err = m.WithTx(ctx, func(m Models) error {
+			stored.Name = "Committed"
+			return m.UserModel.Update(ctx, stored)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		committed, err := m.UserModel.Get(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if committed.Name != "Committed" {
+			t.Errorf("name after commit = %q, want %q", committed.Name, "Committed")
+		}
+	})
+}
+
+func TestIsSerializationFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"deadlock", &pq.Error{Code: "40P01"}, true},
+		{"wrapped", fmt.Errorf("update: %w", &pq.Error{Code: "40001"}), true},
+		{"unique violation", &pq.Error{Code: "23505"}, false},
+		{"other error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSerializationFailure(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 序列化冲突时整个fn重新执行，上一次尝试的写入已经回滚；fn在开头恢复写回的版本号，重试时不会误报编辑冲突
+func TestWithTxRetry(t *testing.T) {
+	if testDB == nil {
+		t.Skip("GREENLIGHT_TEST_DB_DSN is not set")
+	}
+	ctx := context.Background()
+	m := NewModels(testDB)
+	owner := newTestUser(t, m)
+	org := newTestOrganization(t, m, owner)
+	movie := newTestMovie(t, m, org, owner, "Heat", 1995, 170, "crime")
+	version := movie.Version
+
+	attempts := 0
+	err := m.WithTxOptions(ctx, nil, func(m Models) error {
+		attempts++
+		movie.Version = version
+		movie.Title = fmt.Sprintf("Heat %d", attempts)
+		if err := m.MovieModel.Update(ctx, movie); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return &pq.Error{Code: "40001"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+
+	stored, err := m.MovieModel.Get(ctx, org.ID, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "Heat 2" || stored.Version != version+1 {
+		t.Errorf("stored movie = %q version %d, want %q version %d", stored.Title, stored.Version, "Heat 2", version+1)
+	}
+
+	// 其他错误不重试
+	attempts = 0
+	err = m.WithTx(ctx, func(m Models) error {
+		attempts++
+		return &pq.Error{Code: "23505"}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("got %v after %d attempts, want the error after 1 attempt", err, attempts)
+	}
+
+	// 一直冲突时最多尝试maxTxAttempts次
+	attempts = 0
+	err = m.WithTx(ctx, func(m Models) error {
+		attempts++
+		return &pq.Error{Code: "40P01"}
+	})
+	if !isSerializationFailure(err) || attempts != maxTxAttempts {
+		t.Errorf("got %v after %d attempts, want a serialization failure after %d attempts", err, attempts, maxTxAttempts)
+	}
+}
@@ -5,43 +5,21 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/embracexyz/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lib/pq"
 )
 
 var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 )
 
-type password struct {
-	plaintext *string // 指针可以通过nil判断是否传值了
-	hash      []byte
-}
-
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
-	if err != nil {
-		return err
-	}
-
-	p.plaintext = &plaintextPassword
-	p.hash = hash
-	return nil
-}
-
-func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-	return true, nil
+// users.email上的唯一约束冲突（citext，大小写不敏感）
+func isDuplicateEmail(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "users_email_key"
 }
 
 // 预定义一个匿名用户
@@ -59,26 +37,34 @@ type User struct {
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+	// 签发的jwt中携带该值，递增后此前签发的所有jwt即失效
+	TokenGeneration int `json:"-"`
+	// 认证时从jwt claims中得到的权限，nil表示需要从数据库查询
+	Permissions Permisions `json:"-"`
+	// jwt的org claim指定的组织，Permissions是该组织内的权限；0表示没有指定组织
+	OrganizationID int64 `json:"-"`
+	// 只由jwt claims构建，没有从数据库读取姓名、邮箱等资料
+	FromClaims bool `json:"-"`
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB dbtx
 }
 
-func NewUserModel(db *sql.DB) UserModel {
+func NewUserModel(db dbtx) UserModel {
 	return UserModel{DB: db}
 }
 
-func (m UserModel) Get(id int64) (*User, error) {
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
 	query := `
-	SELECT id, created_at, name, email, password_hash, activated, version from users where id = $1`
+	SELECT id, created_at, name, email, password_hash, activated, version, token_generation from users where id = $1`
 
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(&user.ID,
-		&user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version,
+		&user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version, &user.TokenGeneration,
 	)
 	if err != nil {
 		switch {
@@ -91,21 +77,21 @@ func (m UserModel) Get(id int64) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
 		insert into users (name, email, password_hash, activated)
 		values ($1, $2, $3, $4)
-		returning id, created_at, version
+		returning id, created_at, version, token_generation
 	`
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version, &user.TokenGeneration)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case isDuplicateEmail(err):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -114,16 +100,16 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
-		select id, created_at, name, email, password_hash, activated, version
+		select id, created_at, name, email, password_hash, activated, version, token_generation
 		from users
 		where email = $1`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
 	var u User
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.Password.hash, &u.Activated, &u.Version)
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.Password.hash, &u.Activated, &u.Version, &u.TokenGeneration)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -135,20 +121,22 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &u, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 		update users set name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
 		where id = $5 and version = $6
 		returning version
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, user.Name, user.Email, user.Password.hash, user.Activated, user.ID, user.Version).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
+		case isDuplicateEmail(err):
+			return ErrDuplicateEmail
 		default:
 			return err
 		}
@@ -156,10 +144,10 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	hash := sha256.Sum256([]byte(tokenPlaintext))
 	query := `
-		select users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		select users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.token_generation
 		from users
 		inner join tokens
 		on users.id = tokens.user_id
@@ -169,11 +157,11 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	`
 	args := []any{hash[:], tokenScope, time.Now()}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withQueryTimeout(ctx)
 	defer cancel()
 
 	var user User
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version, &user.TokenGeneration)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -185,20 +173,125 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	return &user, nil
 }
 
+// 吊销用户此前签发的所有jwt
+func (m UserModel) RevokeTokens(ctx context.Context, id int64) error {
+	query := `
+		update users set token_generation = token_generation + 1
+		where id = $1
+	`
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 删除用户：tokens、permissions等通过外键级联删除；只留下一条不含邮箱明文的墓碑记录，
+// 邮箱因此可以被重新注册
+func (m UserModel) Delete(ctx context.Context, id int64) error {
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx dbtx) error {
+		query := `
+			insert into users_tombstones (user_id, email_hash, created_at)
+			select id, sha256(convert_to(lower(email::text), 'UTF8')), created_at
+			from users
+			where id = $1
+		`
+		result, err := tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+
+		rowAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		_, err = tx.ExecContext(ctx, `delete from users where id = $1`, id)
+		return err
+	})
+}
+
+// 管理后台使用，email为空时不过滤，否则按子串匹配（不区分大小写）
+func (m UserModel) GetAll(ctx context.Context, email string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		select count(*) over(), id, created_at, name, email, activated, version
+		from users
+		where (strpos(lower(email), lower($1)) > 0 or $1 = '')
+		order by %s %s, id ASC
+		limit $2 offset $3
+	`, filters.SortColumn(), filters.SortDirection())
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, email, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err = rows.Scan(&totalRecords, &user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Activated, &user.Version)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return users, caclMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
 func ValidEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
+// 设置密码时的校验，长度上限取决于当前的哈希算法
 func ValidPasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	maxLength := passwordParams.MaxLength()
+	v.Check(len(password) <= maxLength, "password", fmt.Sprintf("must not be more than %d bytes long", maxLength))
+}
+
+// 登录等校验已有密码时只检查全局的长度上限：密码可能是在其他算法下设置的，
+// 例如切换到bcrypt之后，之前设置的超过72字节的密码依然可以登录
+func ValidPasswordInput(v *validator.Validator, password string) {
+	v.Check(password != "", "password", "must be provided")
+	v.Check(len(password) <= maxPasswordLength, "password", fmt.Sprintf("must not be more than %d bytes long", maxPasswordLength))
+}
+
+func ValidName(v *validator.Validator, name string) {
+	v.Check(name != "", "name", "must be provided")
+	v.Check(len(name) <= 500, "name", "must not be more than 500 bytes long")
 }
 
 func ValidatorUser(v *validator.Validator, user *User) {
-	v.Check(user.Name != "", "name", "must be provided")
-	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+	ValidName(v, user.Name)
 
 	ValidEmail(v, user.Email)
 
@@ -0,0 +1,207 @@
+package keyring
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+var (
+	ErrNoActiveKey  = errors.New("keyring: no active signing key")
+	ErrDuplicateKey = errors.New("keyring: duplicate key id")
+	ErrUnknownKey   = errors.New("keyring: unknown key id")
+)
+
+// 一个jwt密钥，HS256使用secret，EdDSA/RS256使用私钥签名、公钥验签
+// 只有公钥的密钥只能用于验签（例如轮换下线的旧密钥）
+type Key struct {
+	ID         string
+	Algorithm  string
+	secret     []byte
+	privateKey crypto.Signer
+	publicKey  crypto.PublicKey
+}
+
+func (k *Key) CanSign() bool {
+	return k.secret != nil || k.privateKey != nil
+}
+
+// Keyring 用当前active的密钥签名，验签时按jwt header中的kid在所有密钥中选择
+// 初始化完成后只读，可以被多个goroutine并发使用
+type Keyring struct {
+	keys     []*Key
+	active   *Key
+	register jwt.KeyRegister
+}
+
+func New() *Keyring {
+	return &Keyring{}
+}
+
+func (k *Keyring) AddHMAC(kid string, secret []byte) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("keyring: empty secret for key %q", kid)
+	}
+	key := &Key{ID: kid, Algorithm: jwt.HS256, secret: secret}
+	return k.add(key)
+}
+
+// 解析PEM编码的Ed25519/RSA私钥或公钥
+func (k *Keyring) AddPEM(kid string, text []byte) error {
+	block, _ := pem.Decode(text)
+	if block == nil {
+		return fmt.Errorf("keyring: no PEM data found for key %q", kid)
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return fmt.Errorf("keyring: unsupported PEM type %q for key %q", block.Type, kid)
+	}
+	if err != nil {
+		return err
+	}
+
+	key := &Key{ID: kid}
+	switch t := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.Algorithm = jwt.EdDSA
+		key.privateKey = t
+		key.publicKey = t.Public()
+	case ed25519.PublicKey:
+		key.Algorithm = jwt.EdDSA
+		key.publicKey = t
+	case *rsa.PrivateKey:
+		key.Algorithm = jwt.RS256
+		key.privateKey = t
+		key.publicKey = &t.PublicKey
+	case *rsa.PublicKey:
+		key.Algorithm = jwt.RS256
+		key.publicKey = t
+	default:
+		return fmt.Errorf("keyring: unsupported key type %T for key %q", t, kid)
+	}
+	return k.add(key)
+}
+
+func (k *Keyring) add(key *Key) error {
+	for _, existing := range k.keys {
+		if existing.ID == key.ID {
+			return ErrDuplicateKey
+		}
+	}
+
+	// 与jwt.KeyRegister中的下标一一对应，验签时按kid选择密钥
+	switch pub := key.publicKey.(type) {
+	case nil:
+		k.register.Secrets = append(k.register.Secrets, key.secret)
+		k.register.SecretIDs = append(k.register.SecretIDs, key.ID)
+	case ed25519.PublicKey:
+		k.register.EdDSAs = append(k.register.EdDSAs, pub)
+		k.register.EdDSAIDs = append(k.register.EdDSAIDs, key.ID)
+	case *rsa.PublicKey:
+		k.register.RSAs = append(k.register.RSAs, pub)
+		k.register.RSAIDs = append(k.register.RSAIDs, key.ID)
+	}
+
+	k.keys = append(k.keys, key)
+	return nil
+}
+
+// 指定用于签名的密钥，必须是已添加且持有私钥/secret的密钥
+func (k *Keyring) SetActive(kid string) error {
+	for _, key := range k.keys {
+		if key.ID == kid {
+			if !key.CanSign() {
+				return fmt.Errorf("keyring: key %q has no private key and cannot sign", kid)
+			}
+			k.active = key
+			return nil
+		}
+	}
+	return ErrUnknownKey
+}
+
+func (k *Keyring) Active() *Key {
+	return k.active
+}
+
+// 使用active密钥签名，并在header中写入kid
+func (k *Keyring) Sign(claims *jwt.Claims) ([]byte, error) {
+	key := k.active
+	if key == nil {
+		return nil, ErrNoActiveKey
+	}
+
+	claims.KeyID = key.ID
+	switch key.Algorithm {
+	case jwt.HS256:
+		return claims.HMACSign(jwt.HS256, key.secret)
+	case jwt.EdDSA:
+		return claims.EdDSASign(key.privateKey.(ed25519.PrivateKey))
+	case jwt.RS256:
+		return claims.RSASign(jwt.RS256, key.privateKey.(*rsa.PrivateKey))
+	default:
+		return nil, jwt.AlgError(key.Algorithm)
+	}
+}
+
+// 验证签名，只校验签名本身，时间/issuer/audience等由调用方校验
+func (k *Keyring) Check(token []byte) (*jwt.Claims, error) {
+	return k.register.Check(token)
+}
+
+// JSON Web Key，只用于对外发布公钥
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// 返回所有非对称密钥的公钥，HMAC secret永远不会被发布
+func (k *Keyring) JWKS() []JWK {
+	keys := []JWK{}
+	for _, key := range k.keys {
+		switch pub := key.publicKey.(type) {
+		case ed25519.PublicKey:
+			keys = append(keys, JWK{
+				Kty: "OKP",
+				Use: "sig",
+				Alg: key.Algorithm,
+				Kid: key.ID,
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{
+				Kty: "RSA",
+				Use: "sig",
+				Alg: key.Algorithm,
+				Kid: key.ID,
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		}
+	}
+	return keys
+}
@@ -60,7 +60,7 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 
 	msg.SetBody("text/plain", plainBody.String())
 	msg.AddAlternative("text/html", htmlBody.String())
-	err = m.mailer.DialAndSend()
+	err = m.mailer.DialAndSend(msg)
 	if err != nil {
 		return err
 	}
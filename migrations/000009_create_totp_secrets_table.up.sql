@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS totp_secrets (
+user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+secret text NOT NULL,
+confirmed bool NOT NULL DEFAULT false,
+last_step bigint NOT NULL DEFAULT 0
+);
\ No newline at end of file
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS email_changes (
+user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+new_email citext NOT NULL
+);
\ No newline at end of file
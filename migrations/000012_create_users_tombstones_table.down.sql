@@ -0,0 +1 @@
+DROP TABLE IF EXISTS users_tombstones;
\ No newline at end of file
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS users_tombstones (
+user_id bigint PRIMARY KEY,
+email_hash bytea NOT NULL,
+created_at timestamp(0) with time zone NOT NULL,
+deleted_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
\ No newline at end of file
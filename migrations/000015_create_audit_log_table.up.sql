@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+id bigserial PRIMARY KEY,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+actor_id bigint,
+action text NOT NULL,
+resource_type text NOT NULL,
+resource_id text NOT NULL DEFAULT '',
+before jsonb,
+after jsonb,
+request_id text NOT NULL DEFAULT '',
+client_ip text NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX IF NOT EXISTS audit_log_actor_id_idx ON audit_log (actor_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_resource_idx ON audit_log (resource_type, resource_id, created_at);
@@ -0,0 +1,21 @@
+DROP INDEX IF EXISTS movies_organization_id_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS organization_id;
+-- 恢复全局授予：用户默认为viewer，默认组织中的editor和owner恢复为全局的editor
+INSERT INTO users_roles (user_id, role_id)
+SELECT users.id, roles.id FROM users, roles WHERE roles.name = 'viewer'
+ON CONFLICT DO NOTHING;
+INSERT INTO users_roles (user_id, role_id)
+SELECT memberships.user_id, editor.id
+FROM memberships
+INNER JOIN roles ON roles.id = memberships.role_id
+CROSS JOIN roles AS editor
+WHERE memberships.organization_id = 1 AND roles.name IN ('editor', 'owner') AND editor.name = 'editor'
+ON CONFLICT DO NOTHING;
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code IN ('movies:read', 'movies:write')
+ON CONFLICT DO NOTHING;
+DROP TABLE IF EXISTS memberships;
+DROP TABLE IF EXISTS organizations;
+DELETE FROM roles WHERE name = 'owner';
+DELETE FROM permissions WHERE code = 'organizations:write';
@@ -0,0 +1,63 @@
+CREATE TABLE IF NOT EXISTS organizations (
+id bigserial PRIMARY KEY,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+name text NOT NULL
+);
+CREATE TABLE IF NOT EXISTS memberships (
+organization_id bigint NOT NULL REFERENCES organizations ON DELETE CASCADE,
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+role_id bigint NOT NULL REFERENCES roles,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+PRIMARY KEY (organization_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS memberships_user_id_idx ON memberships (user_id);
+
+INSERT INTO permissions (code) VALUES ('organizations:write')
+ON CONFLICT (code) DO NOTHING;
+INSERT INTO roles (name) VALUES ('owner');
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'owner' AND permissions.code IN ('movies:read', 'movies:write', 'organizations:write');
+
+-- 已有的电影和用户归入一个默认组织；成员角色按已有的全局授予（直接授予或角色授予，含通配符）映射：
+-- 管理员成为owner，有movies:write的成为editor，其余为viewer
+INSERT INTO organizations (id, name) VALUES (1, 'Default');
+SELECT setval('organizations_id_seq', (SELECT max(id) FROM organizations));
+INSERT INTO memberships (organization_id, user_id, role_id)
+SELECT 1, users.id, roles.id
+FROM users
+CROSS JOIN LATERAL (
+    SELECT CASE
+        WHEN bool_or(granted.code IN ('*', '*:*', '*:write', 'admin:*', 'admin:write')) THEN 'owner'
+        WHEN bool_or(granted.code IN ('*', '*:*', '*:write', 'movies:*', 'movies:write')) THEN 'editor'
+        ELSE 'viewer'
+    END AS name
+    FROM (
+        SELECT permissions.code
+        FROM users_permissions
+        INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+        WHERE users_permissions.user_id = users.id
+        UNION ALL
+        SELECT permissions.code
+        FROM users_roles
+        INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+        INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+        WHERE users_roles.user_id = users.id
+    ) AS granted
+) AS mapped
+INNER JOIN roles ON roles.name = mapped.name;
+
+-- 电影和组织的权限只来自组织内的角色，全局授予的这部分权限已经映射到默认组织，不再生效
+DELETE FROM users_roles USING roles
+WHERE users_roles.role_id = roles.id AND roles.name IN ('viewer', 'editor', 'owner');
+DELETE FROM users_permissions USING permissions
+WHERE users_permissions.permission_id = permissions.id
+AND (permissions.code LIKE 'movies:%' OR permissions.code LIKE 'organizations:%');
+DELETE FROM roles_permissions USING roles, permissions
+WHERE roles_permissions.role_id = roles.id AND roles_permissions.permission_id = permissions.id
+AND roles.name = 'admin' AND permissions.code LIKE 'movies:%';
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS organization_id bigint REFERENCES organizations ON DELETE CASCADE;
+UPDATE movies SET organization_id = 1;
+ALTER TABLE movies ALTER COLUMN organization_id SET NOT NULL;
+CREATE INDEX IF NOT EXISTS movies_organization_id_idx ON movies (organization_id);
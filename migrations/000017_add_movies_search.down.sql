@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS movies_search_vector_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS search_vector;
+DROP FUNCTION IF EXISTS movies_genres_text(text[]);
+ALTER TABLE movies DROP COLUMN IF EXISTS language;
+ALTER TABLE movies DROP COLUMN IF EXISTS plot;
+ALTER TABLE movies DROP COLUMN IF EXISTS description;
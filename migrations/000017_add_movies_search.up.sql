@@ -0,0 +1,17 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS plot text NOT NULL DEFAULT '';
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS language regconfig NOT NULL DEFAULT 'simple';
+
+-- array_to_string不是immutable，生成列中不能直接使用
+CREATE OR REPLACE FUNCTION movies_genres_text(genres text[]) RETURNS text
+LANGUAGE sql IMMUTABLE PARALLEL SAFE
+AS $$ SELECT array_to_string(genres, ' ') $$;
+
+-- 权重：标题A、类型B、简介C、剧情D
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector(language, title), 'A') ||
+    setweight(to_tsvector(language, movies_genres_text(genres)), 'B') ||
+    setweight(to_tsvector(language, description), 'C') ||
+    setweight(to_tsvector(language, plot), 'D')
+) STORED;
+CREATE INDEX IF NOT EXISTS movies_search_vector_idx ON movies USING GIN (search_vector);